@@ -12,23 +12,196 @@ package main
 import (
 	"bufio"
 	"container/heap"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var g struct {
-	// Arguments:
-	network       string // pathname of network topology file
-	blockinterval int    // average time between blocks
-	stopheight    int64  // run until this height is reached
-	traceenable   bool   // show details of each sim step
-	seed          int64  // random number seed, -1 means use wall-clock
+// Command-line arguments.
+var args struct {
+	network       string  // pathname of network topology file
+	matrix        string  // pathname of latency-matrix topology file
+	blockinterval int     // average time between blocks
+	stopheight    int64   // run until this height is reached
+	duration      float64 // run until this simulated time, instead of stopheight
+	warmup        int64   // don't count blocks below this height
+	traceenable   bool    // show details of each sim step
+	traceminer    string  // show only the sim steps of this miner
+	seed          int64   // random number seed, -1 means use wall-clock
+	json          bool    // print the summary as a JSON object
+	csv           string  // pathname of per-block CSV log, empty means none
+	retarget      int     // difficulty adjustment period, zero means none
+	dist          string  // block interval distribution
+	sigma         float64 // lognormal distribution shape parameter
+	bandwidth     float64 // block relay bandwidth, bytes per unit time
+	jitter        float64 // relay delay random variation fraction
+	loss          float64 // probability that a relay is dropped
+	tiebreak      string  // fork choice between equal-height blocks
+	ghost         bool    // heaviest-subtree fork choice instead of longest chain
+	compact       bool    // relay a header first, then the full block
+	headerdelay   float64 // header latency as a fraction of the link latency
+	queue         bool    // blocks sent over a link are sent one at a time
+	fanout        int     // relay each block to at most this many peers
+	fees          string  // per-block fee distribution and mean, see parseFees()
+	subsidy       float64 // block reward, not including fees
+	timing        bool    // report wall-clock time and simulator throughput
+	check         bool    // verify internal consistency after every event
+	record        string  // pathname to record the run's random choices
+	replay        string  // pathname of recorded choices to replay
+	cleanup       int64   // prune old blocks every this many blocks (height)
+	validation    float64 // block verification time before relaying
+	isolation     float64 // report miners with block share this much below hashrate share
+	k             int     // max confirmation depth for reversal statistics
+	buckets       float64 // block interval histogram bucket width, zero for none
+	uncledepth    int     // max stale branch depth that counts as an uncle
+	reorgmatrix   bool    // report which miners' blocks displaced whose
+	propagation   bool    // report how long best-chain blocks take to reach all miners
+	doublespend   int     // max payment confirmations for double-spend races
+	attempts      int     // number of double-spend races per run
+	racedeadline  float64 // time limit of each double-spend race
+	progress      float64 // wall-clock seconds between progress reports
+	checkpoint    string  // pathname to periodically save the simulation state
+	checkevery    int64   // checkpoint interval in blocks (height)
+	resume        string  // pathname of a checkpoint to continue from
+	symmetric     bool    // add missing reverse peer connections
+	runs          int     // number of simulation runs (Monte Carlo)
+	runsverbose   bool    // print the results of each run
+	disconnected  bool    // allow miners that can't receive all blocks
+	dot           string  // pathname of Graphviz DOT topology output
+	dotonly       bool    // exit after writing the DOT file
+	tree          string  // pathname of block tree (DOT) output
+}
+
+// Config is the input to a simulation run.
+type Config struct {
+	miners        []miner       // network topology, from parseNetwork()
+	partitions    []partition   // scheduled network partitions
+	blockinterval int           // average time between blocks
+	stopheight    int64         // run until this height is reached
+	duration      float64       // if nonzero, run until this time (not height)
+	warmup        int64         // blocks below this height aren't counted
+	seed          int64         // random number seed
+	trace         traceFunc     // show details of each sim step (may be nil)
+	csvlog        io.Writer     // one CSV row per mined block (may be nil)
+	tree          io.Writer     // block tree in DOT format (may be nil)
+	progress      io.Writer     // periodic progress reports (may be nil)
+	progressevery time.Duration // wall-clock time between progress reports
+	checkpoint    string        // pathname to save the state, empty for none
+	checkevery    int64         // save the state every this many blocks
+	resume        *checkpoint   // continue from this saved state (may be nil)
+	cleanup       int64         // prune blocks every this many blocks (height)
+	check         bool          // verify invariants after every event, see check()
+	record        io.Writer     // write each random choice, see choice() (may be nil)
+	replay        io.Reader     // take each random choice from here (may be nil)
+	retarget      int           // blocks per difficulty adjustment, zero for none
+	dist          string        // solve-time distribution, see parseDist()
+	sigma         float64       // lognormal distribution shape parameter
+	bandwidth     float64       // bytes per unit time, zero means unlimited
+	jitter        float64       // relay delays vary randomly by this fraction
+	loss          float64       // probability that each relay is dropped
+	tiebreak      string        // equal-height fork choice, see parseTiebreak()
+	ghost         bool          // heaviest-subtree (GHOST) fork choice
+	compact       bool          // headers-first (compact block) relay
+	headerdelay   float64       // header latency, fraction of the link latency
+	queue         bool          // each link sends one block at a time
+	fanout        int           // relay to at most this many peers, zero for all
+	fees          string        // per-block fee distribution, see parseFees()
+	subsidy       float64       // block reward, not including fees
+	validation    float64       // default time to verify a received block
+	isolation     float64       // summary flags miners this far below their share
+	k             int           // max confirmations for reversal statistics
+	buckets       float64       // block interval histogram bucket width
+	uncledepth    int           // stale blocks this close to the best chain are uncles
+	reorgmatrix   bool          // count displaced blocks per (loser, winner) miner
+	propagation   bool          // measure best-chain blocks' propagation times
+	doublespend   int           // race to reverse up to this many confirmations
+	attempts      int           // double-spend races per run
+	racedeadline  float64       // give up a race after this long, zero for default
+}
+
+// Stats is the result of a simulation run.
+type Stats struct {
+	totalhash  float64       // sum of miners' hashrates
+	mined      height        // number of blocks mined (including stale)
+	bestchain  height        // number of best-chain blocks
+	stale      height        // number of blocks not on the best chain
+	stalerate  float64       // stale / mined
+	simtime    float64       // time the last best-chain block was mined
+	starttime  float64       // time the last warmup best-chain block was mined
+	aveblock   float64       // average time between best-chain blocks
+	maxreorg   int           // greatest depth reorg
+	difficulty float64       // final difficulty, as block interval
+	retargets  int           // number of best-chain difficulty adjustments
+	dropped    int           // number of relays dropped (lost)
+	queued     int           // number of relays that waited for a busy link
+	queuewait  float64       // total time those relays waited
+	reorgs     []int         // reorgs[d] is the number of reorgs of depth d
+	displaced  [][]int       // see state.displaced, nil if not counted
+	proptimes  []float64     // best-chain blocks' propagation times, sorted
+	minerstats []minerStats  // one per miner, same order as Config.miners
+	poolstats  []minerStats  // one per pool, members combined
+	scheduled  bool          // some miner has hashrate changes (hashrate-at)
+	confirmed  []int         // confirmed[d] blocks reached d confirmations
+	reversals  []int         // reversals[d] of those were later reorged away
+	races      int           // number of completed double-spend races
+	raceswon   []int         // raceswon[d] reversed a payment with d confirmations
+	intervals  []int         // best-chain block interval histogram
+	uncles     height        // number of stale blocks that are uncles
+	uncled     bool          // uncles are being counted (Config.uncledepth)
+	revenue    float64       // total rewards (subsidy and fees) of best-chain blocks
+	fees       bool          // fees are enabled, so revenue differs from blocks
+	events     int64         // number of events processed
+	elapsed    time.Duration // wall-clock time simulate() took
+}
+
+type minerStats struct {
+	name     string
+	hashrate float64 // from the network topology
+	mined    height  // how many total blocks mined (including reorg)
+	credit   height  // how many best-chain blocks mined
+	avehash  float64 // time-weighted average (active) hashrate
+	delay    float64 // average latency to outbound peers
+	uncles   height  // how many of our stale blocks are uncles
+	revenue  float64 // subsidy plus fees of our best-chain blocks
+}
+
+// The simulator state, one instance per simulate() run.
+type state struct {
+	blockinterval int     // average time between blocks
+	stopheight    int64   // run until this height is reached
+	duration      float64 // if nonzero, run until this time (not height)
+	retarget      int     // blocks per difficulty adjustment, zero for none
+	warmup        height  // lowest height counted in the results (at least 1)
+	warmuptime    float64 // time the best-chain block below warmup was mined
+	dist          distribution
+	sigma         float64         // lognormal distribution shape parameter
+	bandwidth     float64         // bytes per unit time, zero means unlimited
+	jitter        float64         // relay delays vary randomly by this fraction
+	loss          float64         // probability that each relay is dropped
+	tiebreak      tiebreak        // fork choice between equal-height blocks
+	ghost         bool            // heaviest-subtree fork choice, see ghostBetter()
+	compact       bool            // relay headers first, see relay()
+	headerdelay   float64         // header latency, fraction of the link latency
+	queue         bool            // each link sends one block at a time
+	fanout        int             // relay to at most this many peers, zero for all
+	feedist       distribution    // exponential or deterministic (flat)
+	feemean       float64         // average fee per block, zero for no fees
+	subsidy       float64         // block reward, not including fees
+	feesrc        *countingSource // for fees, so they don't change solve times
+	feer          *rand.Rand
 
 	// Main simulator state:
 	currenttime float64   // simulated time since start
@@ -37,26 +210,108 @@ var g struct {
 	eventlist   eventlist // priority queue, lowest timestamp first
 
 	// Implementation detail simulator state:
-	maxHeight   height     // greatest height any miner has reached
-	baseblockid blockid    // blocks[0] corresponds to this block id
-	r           *rand.Rand // for block interval calculation
-	maxreorg    int        // greatest depth reorg
-	trace       traceFunc  // show details of each sim step
-	totalhash   int        // sum of miners' hashrates
-	mined       height     // number of blocks mined up to baseblock
+	maxHeight   height          // greatest height any miner has reached
+	baseblockid blockid         // blocks[0] corresponds to this block id
+	r           *rand.Rand      // for relay delays (each miner has its own)
+	src         *countingSource // s.r's source, for checkpoints
+	maxreorg    int             // greatest depth reorg
+	tracer      traceFunc       // show details of each sim step, see trace()
+	totalhash   float64         // sum of active miners' hashrates
+	basehash    float64         // totalhash at time zero, sets initial difficulty
+	initialhash []float64       // per miner, configured hashrate (see hashrate-at)
+	mined       height          // number of blocks mined up to baseblock
+	csvlog      *csv.Writer     // one row per mined block, nil if disabled
+	tree        *bufio.Writer   // block tree (DOT), nil if disabled
+	progress    io.Writer       // progress reports, nil if disabled
+	events      int64           // number of events processed
+	retargets   int             // number of best-chain difficulty adjustments
+	pools       []pool          // in order of first member
+	geneses     []string        // genesis names, in order of first miner
+	dropped     int             // number of relays dropped (lost)
+	queued      int             // number of relays that waited for a link
+	targets     []int           // relay()'s peer indices, reused to save allocation
+	queuewait   float64         // total time relays waited for links
+	reorgs      []int           // reorgs[d] is the number of depth-d reorgs
+	displaced   [][]int         // [l][w]: l's blocks reorged away for w's, or nil
+	propagation bool            // track when blocks reach all miners, see adopt()
+	proptimes   []float64       // best-chain blocks' propagation times
+	partitions  []partition     // scheduled network partitions
+	k           int             // track confirmations up to this depth
+	confirmed   []int           // confirmed[d] blocks reached d confirmations
+	reversals   []int           // reversals[d] of those were later reorged away
+	buckets     float64         // interval histogram bucket width, zero for none
+	intervals   []int           // intervals[i] is the count in bucket i
+	uncledepth  int             // see Config.uncledepth, zero to disable
+	uncles      height          // number of stale blocks that are uncles
+	check       bool            // verify invariants after every event
+	tape        *tape           // -record or -replay, nil if neither
+	checked     blockid         // blocks before this one have been checked
+	nactive     int             // number of active miners
+	final       blockid         // newest block on all active tips' chains, zero if none
+	ghostfloor  height          // greatest height final has had, see see()
+
+	// Double-spend races (-doublespend), see raceStart().
+	attacker     int     // miner index, -1 if none
+	doublespend  int     // payment confirmations to race against, 1 to this
+	attempts     int     // number of races to run
+	racedeadline float64 // time limit of each race
+	races        int     // number of completed races
+	raceswon     []int   // raceswon[d] reversed a payment with d confirmations
+	racepay      height  // height of the first honest block since the start
+	racehonest   height  // highest honest tip since the start
+	racewon      int     // the most confirmations the attacker has beaten
 }
 
 type (
 	height  int64
 	blockid int64
 	block   struct {
-		parent blockid // first block is the only block with parent = zero
+		parent blockid // genesis blocks are the only ones with parent = zero
 		height height  // more than one block can have the same height
 		miner  int     // which miner found this block
-		time   float64 // time this block was mined
+		time   float64 // timestamp: time mined, plus the miner's clock skew
+		best   bool    // on the best chain (known only when pruned)
+		size   int     // bytes, adds size/bandwidth to the relay delay
+		fee    float64 // transaction fees (see -fees)
+
+		// Expected number of hashes to mine a child of this block.
+		difficulty  float64
+		periodstart float64 // time of the most recent retarget block
+
+		// Most confirmations (1 means at the tip) this block reached on
+		// any honest miner's chain, and the most it had when such a
+		// miner reorged it away (zero if never), see Config.k.
+		confirms int
+		reversed int
+
+		// Per miner, the number of blocks in the subtree rooted at
+		// this block (including itself) that the miner has seen, zero
+		// if it hasn't seen this block (maintained only for -ghost, and
+		// only above ghostfloor, see see()).
+		weights []int
+
+		// For stale blocks, how far above the best chain (for -uncles,
+		// set while pruning, see cleanBlocks()).
+		above int
+
+		// Number of active miners whose tips are this block or one of
+		// its descendants, see moveTip().
+		tips int
+
+		// For -propagation: which miners have mined on this block or a
+		// descendant (or weren't active when it was mined), how many
+		// haven't yet, and the time from its mining until they all had.
+		adopters   []bool
+		waiting    int
+		propagated float64
+
+		// Which miners have mined on this block or broken a tie with
+		// it (only for a tiebreak other than first-seen), see tied().
+		seen []bool
 	}
 
-	// The set of miners and their peers is static (at least for now).
+	// The set of miners and their peers is static, but miners may
+	// join (start mining) and leave (stop) at configured times.
 	peer struct {
 		miner int
 		delay float64
@@ -64,62 +319,534 @@ type (
 	miner struct {
 		name     string
 		index    int     // in miner[]
-		hashrate int     // how much hashing power this miner has
-		mined    height  // how many total blocks we've mined (including reorg)
+		hashrate float64 // how much hashing power this miner has
+		mined    height  // how many total blocks we've mined up to baseblock (including reorg)
 		credit   height  // how many best-chain blocks we've mined
+		uncles   height  // how many of our stale blocks are uncles
+		revenue  float64 // subsidy plus fees of our best-chain blocks
 		peers    []peer  // outbound peers (we forward blocks to these miners)
-		tip      blockid // the blockid we're trying to mine onto, initially 1
+		tip      blockid // the blockid we're trying to mine onto, initially genesis
+		size     int     // size (bytes) of the blocks we mine
+		// time to verify a received block before relaying it,
+		// negative means use Config.validation
+		validation float64
+		r          *rand.Rand      // for our solve times, independent of other miners
+		src        *countingSource // r's source, for checkpoints
+		linkfree   []float64       // per peer, when the link can send (-queue)
+		relayed    blockid         // the block we most recently relayed
+
+		poolname string  // empty if not in a pool
+		pool     int     // index into pools[], -1 if not in a pool
+		joinat   float64 // time this miner starts mining
+		leaveat  float64 // time this miner stops, zero means never
+		active   bool    // between joinat and leaveat
+		solveat  float64 // when our current mining event fires
+		skew     float64 // our clock offset, added to our blocks' times
+
+		// Scheduled hashrate changes (hashrate-at), and the integral of
+		// our active hashrate over time, up to hashsince.
+		schedule  []hashChange
+		hashwork  float64
+		hashsince float64
+
+		// Selfish mining (block withholding), see selfishMined().
+		selfish   bool   // withhold blocks rather than relay immediately
+		pubheight height // best height the rest of the network knows about
+		race      bool   // published a block to tie a competing block
+
+		attacker bool // double-spend attacker, see raceStart()
+
+		// The genesis block we start on (see "genesis"): its index in
+		// geneses[], and its block id is 1000 plus this index.
+		genesisname string // empty for the default genesis
+		genesis     int
+	}
+
+	hashChange struct {
+		when     float64
+		hashrate float64
+	}
+
+	// Miners in a pool always mine on the same tip, they share blocks
+	// with each other instantly.
+	pool struct {
+		name    string
+		members []int // miner indices
+	}
+
+	// No blocks are relayed between the two sides of a partition while
+	// it's in effect, from start until end.
+	partition struct {
+		start, end float64
+		side       []int8 // per miner: 0 (not partitioned), 1, or 2
+	}
+
+	// The parsed network topology file.
+	network struct {
+		miners     []miner
+		partitions []partition
 	}
 
-	// The only event is the arrival of a block, either mined or relayed.
+	// Most events are the arrival of a block, either mined or relayed.
 	event struct {
-		to     int     // which miner (index) gets the block
-		mining bool    // block arrival from our mining (true) or peer (false)
-		when   float64 // time of block arrival
-		bid    blockid // block being mined on (parent) or block from peer
+		to   int       // which miner (index) gets the block
+		kind eventkind // what happens to this miner
+		when float64   // time of block arrival
+		bid  blockid   // block being mined on (parent) or block from peer
+		from int       // for a block from a peer, which miner sent it
 	}
+	eventkind int
 	eventlist []event
 )
 
 func init() {
+	flag.StringVar(&args.network, "f", "./network", "network topology file, - for standard input")
+	flag.StringVar(&args.matrix, "matrix", "", "latency-matrix network topology file (instead of -f), - for standard input")
+	flag.BoolVar(&args.symmetric, "symmetric", false, "add the reverse of each peer connection (same delay)")
+	flag.IntVar(&args.blockinterval, "i", 600, "average block interval")
+	flag.Int64Var(&args.stopheight, "h", 1_000_000, "stopping height")
+	flag.Float64Var(&args.duration, "duration", 0, "stopping simulated time (instead of -h)")
+	flag.Int64Var(&args.warmup, "warmup", 0, "don't count blocks below this height in the results")
+	flag.BoolVar(&args.traceenable, "t", false, "print execution trace to stdout")
+	flag.StringVar(&args.traceminer, "trace-miner", "", "print execution trace to stdout for only this miner")
+	flag.Int64Var(&args.seed, "s", 0, "random number seed, -1 to use wall-clock")
+	flag.BoolVar(&args.json, "json", false, "print summary as JSON")
+	flag.StringVar(&args.csv, "csv", "", "write per-block CSV log to this file")
+	flag.IntVar(&args.retarget, "retarget", 0, "difficulty adjustment interval (blocks), 0 for none")
+	flag.StringVar(&args.dist, "dist", "exponential", "solve time distribution: exponential, deterministic, lognormal")
+	flag.Float64Var(&args.sigma, "sigma", 1.0, "lognormal distribution shape parameter")
+	flag.Float64Var(&args.bandwidth, "bandwidth", 0, "relay bandwidth (bytes per unit time), 0 for unlimited")
+	flag.Float64Var(&args.jitter, "jitter", 0, "relay delay random variation (fraction, 0 to 1)")
+	flag.Float64Var(&args.loss, "loss", 0, "probability that each block relay is dropped")
+	flag.StringVar(&args.tiebreak, "tiebreak", "first-seen", "equal-height fork choice: first-seen, last-seen, random, hashrate-weighted")
+	flag.BoolVar(&args.ghost, "ghost", false, "GHOST fork choice: prefer the heaviest subtree (most blocks) rather than the longest chain")
+	flag.BoolVar(&args.compact, "compact", false, "headers-first relay: miners switch to a block when its header arrives, relay it when the full block arrives")
+	flag.Float64Var(&args.headerdelay, "header-delay", 0.25, "with -compact, header latency as a fraction of the link latency")
+	flag.BoolVar(&args.queue, "queue", false, "with -bandwidth, blocks relayed over the same link queue (are sent one at a time)")
+	flag.IntVar(&args.fanout, "fanout", 0, "relay each block to only this many (randomly chosen) peers, zero for all")
+	flag.StringVar(&args.fees, "fees", "", "per-block fees, flat:AMOUNT or exponential:MEAN, empty for none")
+	flag.Float64Var(&args.subsidy, "subsidy", 1, "with -fees, block reward not including fees")
+	flag.BoolVar(&args.timing, "timing", false, "report the wall-clock run time and events processed per second")
+	flag.BoolVar(&args.check, "check", false, "verify the simulator's internal consistency after every event (slow, for development)")
+	flag.StringVar(&args.record, "record", "", "write the outcome of every random choice (solve times, relay drops, ...) to this file")
+	flag.StringVar(&args.replay, "replay", "", "use the random choices recorded (by -record) in this file")
+	flag.Int64Var(&args.cleanup, "cleanup", 10000, "prune blocks that can no longer be reorged every this many blocks (height)")
+	flag.Float64Var(&args.validation, "validation", 0, "time to verify a received block before relaying it")
+	flag.Float64Var(&args.isolation, "isolation", 2, "report miners whose block fraction is less than their hashrate fraction divided by this, zero to disable")
+	flag.IntVar(&args.k, "k", 0, "report reversal probability for blocks with up to this many confirmations, zero for none")
+	flag.Float64Var(&args.buckets, "interval-buckets", 0, "report a histogram of best-chain block intervals with this bucket width, zero for none")
+	flag.IntVar(&args.uncledepth, "uncles", 0, "count stale blocks at most this far above the best chain as uncles, zero for none")
+	flag.BoolVar(&args.reorgmatrix, "reorg-matrix", false, "report how many of each miner's blocks were reorged away in favor of each other miner's")
+	flag.BoolVar(&args.propagation, "propagation", false, "report how long best-chain blocks take to reach all miners")
+	flag.IntVar(&args.doublespend, "doublespend", 0, "race the attacker miner to reverse payments with up to this many confirmations, zero for none")
+	flag.IntVar(&args.attempts, "attempts", 100, "with -doublespend, number of races per run")
+	flag.Float64Var(&args.racedeadline, "race-deadline", 0, "with -doublespend, give up each race after this much time, zero for 10 block intervals per confirmation")
+	flag.Float64Var(&args.progress, "progress", 0, "print progress to standard error every this many (wall-clock) seconds, zero for none")
+	flag.StringVar(&args.checkpoint, "checkpoint", "", "periodically save the simulation state to this file")
+	flag.Int64Var(&args.checkevery, "checkpoint-every", 10000, "save the state every this many blocks (height)")
+	flag.StringVar(&args.resume, "resume", "", "continue the simulation saved in this checkpoint file")
+	flag.IntVar(&args.runs, "runs", 1, "number of runs (seeds seed, seed+1, ...), print aggregate results")
+	flag.BoolVar(&args.runsverbose, "runs-verbose", false, "with -runs, also print each run's results")
+	flag.BoolVar(&args.disconnected, "allow-disconnected", false, "allow a network that isn't strongly connected")
+	flag.StringVar(&args.dot, "dot", "", "write network topology in Graphviz DOT format to this file")
+	flag.BoolVar(&args.dotonly, "dot-only", false, "exit after writing the -dot file")
+	flag.StringVar(&args.tree, "tree", "", "write the tree of all mined blocks in DOT format to this file")
+}
+
+// The distribution of the time to solve (mine) a block.
+type distribution int
+
+const (
+	exponential   distribution = iota // memoryless, like real mining
+	deterministic                     // always exactly the mean
+	lognormal                         // mean-preserving, shape from sigma
+)
+
+// Parse the -fees specification, a distribution (flat, which is the same
+// as deterministic, or exponential), a colon, and the mean fee per block.
+func parseFees(spec string) (distribution, float64, error) {
+	if spec == "" {
+		return exponential, 0, nil
+	}
+	v := strings.Split(spec, ":")
+	if len(v) != 2 {
+		return 0, 0, fmt.Errorf("bad fees: %s", spec)
+	}
+	mean, err := strconv.ParseFloat(v[1], 64)
+	if err != nil || mean < 0 {
+		return 0, 0, fmt.Errorf("bad fee amount: %s", spec)
+	}
+	switch v[0] {
+	case "flat":
+		return deterministic, mean, nil
+	case "exponential":
+		return exponential, mean, nil
+	}
+	return 0, 0, fmt.Errorf("unknown fee distribution: %s", v[0])
+}
+
+func parseDist(name string) (distribution, error) {
+	switch name {
+	case "", "exponential":
+		return exponential, nil
+	case "deterministic":
+		return deterministic, nil
+	case "lognormal":
+		return lognormal, nil
+	}
+	return 0, fmt.Errorf("unknown distribution: %s", name)
+}
+
+// How a miner chooses between its current tip and a received block
+// of the same height.
+type tiebreak int
+
+const (
+	firstSeen   tiebreak = iota // keep the current tip
+	lastSeen                    // always switch to the received block
+	randomTie                   // switch with probability one-half
+	hashrateTie                 // switch in proportion to the hashrate on each
+)
+
+func parseTiebreak(name string) (tiebreak, error) {
+	switch name {
+	case "", "first-seen":
+		return firstSeen, nil
+	case "last-seen":
+		return lastSeen, nil
+	case "random":
+		return randomTie, nil
+	case "hashrate-weighted":
+		return hashrateTie, nil
+	}
+	return 0, fmt.Errorf("unknown tiebreak: %s", name)
+}
+
+const (
+	blockMined     eventkind = iota // bid is the block we were mining on
+	blockReceived                   // bid is the block from a peer
+	minerJoin                       // start mining (bid unused)
+	minerLeave                      // stop mining and relaying (bid unused)
+	partitionHeal                   // to is the partition index, not a miner
+	hashrateChange                  // bid is the index into miner.schedule
+	headerReceived                  // bid is the block whose header arrived
+	raceDeadline                    // bid is the race number (s.races)
+)
+
+// A trace function is given the index of the miner that the line is
+// about (the one acting), and of another miner it's about (such as the
+// peer a relay is dropped to), each -1 if none, then the line itself.
+type traceFunc func(mi, peer int, format string, a ...interface{})
+
+// The default trace function does nothing.
+func noTrace(mi, peer int, format string, a ...interface{}) {}
+
+// Print every trace line (-t).
+func allTrace(mi, peer int, format string, a ...interface{}) {
+	fmt.Printf(format, a...)
+}
+
+// Return a trace function that prints only the lines about miner mi.
+func minerTrace(mi int) traceFunc {
+	return func(m, peer int, format string, a ...interface{}) {
+		if m == mi || peer == mi {
+			fmt.Printf(format, a...)
+		}
+	}
+}
+
+// Trace a step taken by miner mi (-1 if it's not about one miner).
+func (s *state) trace(mi int, format string, a ...interface{}) {
+	s.tracer(mi, -1, format, a...)
+}
+
+func newState(cfg Config, dist distribution, tb tiebreak) *state {
+	s := &state{
+		dist:          dist,
+		tiebreak:      tb,
+		ghost:         cfg.ghost,
+		compact:       cfg.compact,
+		headerdelay:   cfg.headerdelay,
+		queue:         cfg.queue,
+		fanout:        cfg.fanout,
+		subsidy:       cfg.subsidy,
+		feesrc:        newSource(minerSeed(cfg.seed, -2)), // not a miner
+		sigma:         cfg.sigma,
+		bandwidth:     cfg.bandwidth,
+		jitter:        cfg.jitter,
+		loss:          cfg.loss,
+		blockinterval: cfg.blockinterval,
+		stopheight:    cfg.stopheight,
+		duration:      cfg.duration,
+		retarget:      cfg.retarget,
+		warmup:        height(cfg.warmup),
+		src:           newSource(cfg.seed),
+		tracer:        cfg.trace,
+		k:             cfg.k,
+		buckets:       cfg.buckets,
+		uncledepth:    cfg.uncledepth,
+		progress:      cfg.progress,
+		check:         cfg.check,
+		propagation:   cfg.propagation,
+		confirmed:     make([]int, cfg.k+1),
+		reversals:     make([]int, cfg.k+1),
+		attacker:      -1,
+		doublespend:   cfg.doublespend,
+		attempts:      cfg.attempts,
+		racedeadline:  cfg.racedeadline,
+		raceswon:      make([]int, cfg.doublespend+1),
+	}
+	s.r = rand.New(s.src)
+	s.feer = rand.New(s.feesrc)
+	if s.warmup < 1 {
+		s.warmup = 1 // the genesis block is never counted
+	}
+	if cfg.record != nil {
+		s.tape = &tape{w: bufio.NewWriter(cfg.record)}
+	}
+	if cfg.replay != nil {
+		s.tape = &tape{r: bufio.NewScanner(cfg.replay)}
+	}
 	// Genesis block.
-	g.blocks = append(g.blocks, block{
+	s.blocks = append(s.blocks, block{
 		parent: 0,
 		height: 0,
 		miner:  -1,
 		time:   0,
 	})
-	g.baseblockid = 1000 // arbitrary but helps distinguish ids from heights
-	g.eventlist = make([]event, 0)
-	g.trace = func(format string, a ...interface{}) (n int, err error) {
-		// The default trace function does nothing.
-		return 0, nil
+	s.baseblockid = 1000 // arbitrary but helps distinguish ids from heights
+	s.eventlist = make([]event, 0)
+	if s.tracer == nil {
+		s.tracer = noTrace
+	}
+	// Each run gets its own copy of the miners, since we modify them.
+	s.miners = make([]miner, len(cfg.miners))
+	copy(s.miners, cfg.miners)
+	s.partitions = cfg.partitions
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		if m.validation < 0 {
+			m.validation = cfg.validation
+		}
+		m.active = m.joinat == 0
+		if m.active {
+			s.totalhash += m.hashrate
+		}
+		s.initialhash = append(s.initialhash, m.hashrate)
+		if s.queue {
+			m.linkfree = make([]float64, len(m.peers))
+		}
+		m.src = newSource(minerSeed(cfg.seed, mi))
+		m.r = rand.New(m.src)
+		if m.attacker {
+			s.attacker = mi
+		}
+		m.genesis = len(s.geneses)
+		for gi, name := range s.geneses {
+			if name == m.genesisname {
+				m.genesis = gi
+			}
+		}
+		if m.genesis == len(s.geneses) {
+			s.geneses = append(s.geneses, m.genesisname)
+		}
+		m.pool = -1
+		if m.poolname == "" {
+			continue
+		}
+		for pi := range s.pools {
+			if s.pools[pi].name == m.poolname {
+				m.pool = pi
+			}
+		}
+		if m.pool < 0 {
+			m.pool = len(s.pools)
+			s.pools = append(s.pools, pool{name: m.poolname})
+		}
+		s.pools[m.pool].members = append(s.pools[m.pool].members, mi)
+	}
+	s.basehash = s.totalhash
+	if cfg.reorgmatrix {
+		s.displaced = make([][]int, len(s.miners))
+		for mi := range s.displaced {
+			s.displaced[mi] = make([]int, len(s.miners))
+		}
+	}
+	// Each additional genesis block starts an independent chain.
+	for len(s.blocks) < len(s.geneses) {
+		s.blocks = append(s.blocks, block{miner: -1})
+	}
+	for i := range s.blocks {
+		s.blocks[i].difficulty = float64(s.blockinterval) * s.basehash
+		if s.ghost {
+			s.blocks[i].weights = make([]int, len(s.miners))
+		}
+		if s.tiebreak != firstSeen {
+			s.blocks[i].seen = make([]bool, len(s.miners))
+		}
+	}
+	if cfg.csvlog != nil {
+		s.csvlog = csv.NewWriter(cfg.csvlog)
+		s.csvlog.Write([]string{"blockid", "height", "miner-index",
+			"miner-name", "parent-blockid", "mine-time", "best-chain"})
+	}
+	if cfg.tree != nil {
+		s.tree = bufio.NewWriter(cfg.tree)
+		fmt.Fprintln(s.tree, "digraph blocks {")
+		fmt.Fprintln(s.tree, "  rankdir=LR;")
+		for i := range s.blocks {
+			fmt.Fprintf(s.tree, "  %d [label=\"genesis\"];\n",
+				s.baseblockid+blockid(i))
+		}
+	}
+	return s
+}
+
+// Records (-record) or replays (-replay) the outcome of each random choice
+// the simulator makes, so a run can be reproduced exactly even after changes
+// to the code that makes them (such as the solve time distributions).
+type tape struct {
+	w    *bufio.Writer  // recording, or nil
+	r    *bufio.Scanner // replaying, or nil
+	line int            // replay line number
+	err  error          // the replay doesn't match this run
+}
+
+// Format v so that it parses back to exactly the same value.
+func exact(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// The random outcome v (of the given kind, by miner mi, or -1 if none)
+// has been chosen; record it, or replace it with the recorded outcome.
+// Each line of the recording is the time, kind, miner, and outcome, in the
+// order they were chosen. When replaying, these must match the run (other
+// than the outcomes), otherwise the run stops with an error.
+func (s *state) choice(kind string, mi int, v float64) float64 {
+	t := s.tape
+	if t == nil {
+		return v
+	}
+	name := "-"
+	if mi >= 0 {
+		name = s.miners[mi].name
+	}
+	if t.w != nil {
+		fmt.Fprintln(t.w, exact(s.currenttime), kind, name, exact(v))
+		return v
+	}
+	if t.err != nil {
+		return v
+	}
+	t.line++
+	if !t.r.Scan() {
+		t.err = fmt.Errorf("replay ended at line %d", t.line)
+		if err := t.r.Err(); err != nil {
+			t.err = err
+		}
+		return v
+	}
+	f := strings.Fields(t.r.Text())
+	if len(f) != 4 || f[0] != exact(s.currenttime) || f[1] != kind ||
+		f[2] != name {
+		t.err = fmt.Errorf("replay diverged at line %d: expected %s %s %s, "+
+			"recorded %s", t.line, exact(s.currenttime), kind, name,
+			t.r.Text())
+		return v
+	}
+	r, err := strconv.ParseFloat(f[3], 64)
+	if err != nil {
+		t.err = fmt.Errorf("replay line %d: bad value: %s", t.line, f[3])
+		return v
+	}
+	return r
+}
+
+// A random number source that counts the values it has generated, so its
+// state can be saved (as just the seed and count) and restored by replaying.
+type countingSource struct {
+	src   rand.Source64
+	seed  int64
+	draws uint64
+}
+
+func newSource(seed int64) *countingSource {
+	return &countingSource{
+		src:  rand.NewSource(seed).(rand.Source64),
+		seed: seed,
 	}
+}
+
+func (cs *countingSource) Int63() int64 {
+	cs.draws++
+	return cs.src.Int63()
+}
+
+func (cs *countingSource) Uint64() uint64 {
+	cs.draws++
+	return cs.src.Uint64()
+}
+
+func (cs *countingSource) Seed(seed int64) {
+	cs.src.Seed(seed)
+	cs.seed, cs.draws = seed, 0
+}
 
-	flag.StringVar(&g.network, "f", "./network", "network topology file")
-	flag.IntVar(&g.blockinterval, "i", 600, "average block interval")
-	flag.Int64Var(&g.stopheight, "h", 1_000_000, "stopping height")
-	flag.BoolVar(&g.traceenable, "t", false, "print execution trace to stdout")
-	flag.Int64Var(&g.seed, "s", 0, "random number seed, -1 to use wall-clock")
+// Advance the (newly-seeded) source to the given number of draws.
+func (cs *countingSource) replay(draws uint64) {
+	for cs.draws < draws {
+		cs.Uint64()
+	}
 }
 
-type traceFunc func(format string, a ...interface{}) (n int, err error)
+// Derive a miner's random number seed from the simulation seed, so that
+// each miner's sequence of solve times doesn't depend on the other miners.
+// This is the splitmix64 mixing function.
+func minerSeed(seed int64, mi int) int64 {
+	z := uint64(seed) + uint64(mi+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return int64(z ^ (z >> 31))
+}
 
-func validblock(bid blockid) bool {
-	return bid >= g.baseblockid &&
-		int(bid-g.baseblockid) < len(g.blocks)
+func (s *state) validblock(bid blockid) bool {
+	return bid >= s.baseblockid &&
+		int(bid-s.baseblockid) < len(s.blocks)
 }
-func getblock(bid blockid) *block {
-	return &g.blocks[bid-g.baseblockid]
+func (s *state) getblock(bid blockid) *block {
+	return &s.blocks[bid-s.baseblockid]
 }
-func getheight(bid blockid) height {
-	return g.blocks[int(bid-g.baseblockid)].height
+func (s *state) getheight(bid blockid) height {
+	return s.blocks[int(bid-s.baseblockid)].height
 }
 
 // Helper functions for the eventlist heap (priority queue)
-func (e eventlist) Len() int           { return len(e) }
-func (e eventlist) Less(i, j int) bool { return e[i].when < e[j].when }
-func (e eventlist) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e eventlist) Len() int      { return len(e) }
+func (e eventlist) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// Events at the same time are ordered by the other fields, so that ties
+// (which are common with the deterministic distribution) don't depend on
+// the heap's internal order.
+func (e eventlist) Less(i, j int) bool {
+	a, b := &e[i], &e[j]
+	if a.when != b.when {
+		return a.when < b.when
+	}
+	if a.to != b.to {
+		return a.to < b.to
+	}
+	if a.kind != b.kind {
+		return a.kind < b.kind
+	}
+	return a.bid < b.bid
+}
 func (e *eventlist) Push(x interface{}) {
 	*e = append(*e, x.(event))
 }
@@ -131,277 +858,3087 @@ func (e *eventlist) Pop() interface{} {
 	return x
 }
 
-// Relay a newly-discovered block (either mined or relayed to us) to our peers.
-// This sends a message to the peer we received the block from (if it's one
-// of our peers), but that's okay, it will be ignored.
-func relay(mi int, newblockid blockid) {
-	m := &g.miners[mi]
-	for _, p := range m.peers {
+// Relay a newly-discovered block (either mined or relayed to us) to our peers,
+// other than the one we received it from (from, -1 if none). If received is
+// true, we must first verify the block (we've already verified blocks we mined).
+func (s *state) relay(mi int, newblockid blockid, received bool, from int) {
+	m := &s.miners[mi]
+	m.relayed = newblockid
+	newheight := s.getheight(newblockid)
+	var transfer float64 // time to send the block itself
+	if s.bandwidth > 0 {
+		transfer = float64(s.getblock(newblockid).size) / s.bandwidth
+	}
+	send := transfer
+	if received {
+		transfer += m.validation
+	}
+	targets := s.targets[:0]
+	for pi, p := range m.peers {
+		if !s.miners[p.miner].active {
+			// It will find the best chain when it joins.
+			continue
+		}
+		if p.miner == from || s.partitioned(mi, p.miner) {
+			continue
+		}
 		// Improve simulator efficiency by not relaying blocks
-		// that are certain to be ignored.
-		if getheight(g.miners[p.miner].tip) < getheight(newblockid) {
-			heap.Push(&g.eventlist, event{
-				to:     p.miner,
-				mining: false,
-				when:   g.currenttime + p.delay,
-				bid:    newblockid})
+		// that are certain to be ignored (an equal-height block
+		// may not be, depending on the tiebreak rule).
+		known := s.knownheight(p.miner)
+		// With GHOST, a lower block can be better.
+		if !s.ghost && (known > newheight ||
+			(known == newheight && s.tiebreak == firstSeen)) {
+			continue
+		}
+		targets = append(targets, pi)
+	}
+	if s.fanout > 0 && len(targets) > s.fanout {
+		// Choose a random subset (partial Fisher-Yates shuffle), but
+		// still relay in peer order.
+		for i := 0; i < s.fanout; i++ {
+			j := i + int(s.choice("fanout", mi,
+				float64(s.r.Intn(len(targets)-i))))
+			targets[i], targets[j] = targets[j], targets[i]
+		}
+		targets = targets[:s.fanout]
+		sort.Ints(targets)
+	}
+	s.targets = targets
+	for _, pi := range targets {
+		p := m.peers[pi]
+		delay, hdelay := p.delay+transfer, p.delay*s.headerdelay
+		if s.loss > 0 && s.choice("drop", mi,
+			boolFloat(s.r.Float64() < s.loss)) != 0 {
+			s.dropped++
+			s.tracer(mi, p.miner, "%.3f %s drop %d to %s\n", s.currenttime,
+				m.name, newblockid, s.miners[p.miner].name)
+			continue
+		}
+		if s.jitter > 0 {
+			// Uniform in [1-jitter, 1+jitter]
+			f := s.choice("jitter", mi, 1+s.jitter*(2*s.r.Float64()-1))
+			delay *= f
+			hdelay *= f
+		}
+		if s.queue {
+			// We can't start sending until the link has finished
+			// sending the blocks ahead of this one.
+			ready := s.currenttime + transfer - send
+			if wait := m.linkfree[pi] - ready; wait > 0 {
+				delay += wait
+				ready += wait
+				s.queued++
+				s.queuewait += wait
+			}
+			m.linkfree[pi] = ready + send
+		}
+		heap.Push(&s.eventlist, event{
+			to:   p.miner,
+			kind: blockReceived,
+			when: s.currenttime + delay,
+			bid:  newblockid,
+			from: mi})
+		if s.compact {
+			// The header is small and is sent before validation.
+			heap.Push(&s.eventlist, event{
+				to:   p.miner,
+				kind: headerReceived,
+				when: s.currenttime + hdelay,
+				bid:  newblockid,
+				from: mi})
 		}
 	}
 }
 
-// Start mining on top of the given existing block
-func startMining(mi int, bid blockid) {
-	m := &g.miners[mi]
-	// We'll mine on top of blockid
-	m.tip = bid
+// The height of the best block this miner is certain to ignore blocks below.
+// A selfish miner's tip may be private, but it must still hear about blocks
+// from honest miners that are below its tip.
+func (s *state) knownheight(mi int) height {
+	m := &s.miners[mi]
+	if m.selfish || s.racing(mi) {
+		return m.pubheight
+	}
+	return s.getheight(m.tip)
+}
 
-	// Schedule an event for when our "mining" will be done.
-	solvetime := -math.Log(1.0-rand.Float64()) *
-		float64(g.blockinterval*g.totalhash) / float64(m.hashrate)
-
-	heap.Push(&g.eventlist, event{
-		to:     mi,
-		mining: true,
-		when:   g.currenttime + solvetime,
-		bid:    bid})
-	g.trace("%.3f %s start-on %d height %d mined %d credit %d solve %.2f\n",
-		g.currenttime, m.name, bid, getheight(bid),
-		m.mined, m.credit, solvetime)
+// Selfish mining follows Eyal and Sirer, "Majority is not Enough: Bitcoin
+// Mining is Vulnerable" (https://arxiv.org/abs/1311.0243). The selfish
+// miner's tip is its private chain; pubheight tracks how much of the
+// best chain (either honest or our own published blocks) is public.
+
+// The selfish miner mi has just mined newblockid. Return true if this block
+// should be relayed (published), false if it should be withheld.
+func (s *state) selfishMined(mi int, newblockid blockid) bool {
+	m := &s.miners[mi]
+	if m.race {
+		// We published a block to tie an honest block, and now we've
+		// mined on top of ours, so publish it and win the race.
+		m.race = false
+		m.pubheight = s.getheight(newblockid)
+		return true
+	}
+	s.trace(mi, "%.3f %s withhold %d lead %d\n", s.currenttime, m.name,
+		newblockid, s.getheight(newblockid)-m.pubheight)
+	return false
 }
 
-// Remove un-needed blocks, give credits to miners.
-func cleanBlocks() {
-	// Find the minimum height that any miner is at.
-	var minheight height
-	for mi, m := range g.miners {
-		h := getheight(m.tip)
-		if mi == 0 || minheight > h {
-			minheight = h
-		}
+// The selfish miner mi has received bid from a peer. Return true if it
+// should abandon its private chain and switch to this block.
+func (s *state) selfishReceived(mi int, bid blockid) bool {
+	m := &s.miners[mi]
+	h := s.getheight(bid)
+	if h <= m.pubheight {
+		// Not news, possibly one of our own published blocks.
+		return false
+	}
+	m.pubheight = h
+	privateheight := s.getheight(m.tip)
+	if h > privateheight {
+		// The honest chain is longer, give up and mine on it.
+		m.race = false
+		return true
 	}
+	switch h {
+	case privateheight:
+		// Publish our tip, which ties the honest block.
+		m.race = true
+	case privateheight - 1:
+		// Our lead was two, publish everything, which beats the honest chain.
+		h = privateheight
+		m.pubheight = h
+	}
+	// Otherwise our lead is more than two, publish just enough to
+	// match the honest chain (which will make it lose).
+	s.publish(mi, h)
+	return false
+}
 
-	// Move down from all tips until they're at the same (minimum) height.
-	blockAtSameHeight := make([]blockid, len(g.miners))
-	for i, m := range g.miners {
-		blockAtSameHeight[i] = m.tip
-		for getheight(blockAtSameHeight[i]) > minheight {
-			blockAtSameHeight[i] = getblock(blockAtSameHeight[i]).parent
-		}
+// Relay the block at the given height on our (selfish, private) chain.
+func (s *state) publish(mi int, h height) {
+	m := &s.miners[mi]
+	bid := m.tip
+	for s.getheight(bid) > h {
+		bid = s.getblock(bid).parent
 	}
-	// Find the block that all tips are based on (oldest branch point).
-	for {
-		// Determine if all the blockAtSameHeight[] are equal.
-		var i int
-		for i = 1; i < len(g.miners); i++ {
-			if blockAtSameHeight[i] != blockAtSameHeight[0] {
-				break
-			}
-		}
-		if i >= len(g.miners) {
-			// Yes, they are all equal.
-			break
-		}
-		// Everyone move down one and try again.
-		for i = 0; i < len(g.miners); i++ {
-			blockAtSameHeight[i] = getblock(blockAtSameHeight[i]).parent
+	s.trace(mi, "%.3f %s release %d height %d\n", s.currenttime, m.name, bid, h)
+	s.relay(mi, bid, false, -1)
+}
+
+// A double-spend race: the attacker pays a merchant, and the payment is
+// in the first block an honest miner mines after the race starts. Meanwhile
+// the attacker mines a private chain (containing a conflicting transaction)
+// from its tip when the race started. If, after the payment has d
+// confirmations, the private chain is ever longer than the highest honest
+// tip, the attacker could publish it and reverse the payment; it wins the
+// race for d. The race ends when the attacker wins for -doublespend
+// confirmations, or at the deadline; the attacker then abandons its private
+// chain (without publishing it) and starts the next race from the best
+// honest tip.
+
+// Return true if miner mi is the attacker and is racing.
+func (s *state) racing(mi int) bool {
+	return mi == s.attacker && mi >= 0 && s.races < s.attempts
+}
+
+// Start the next race from the attacker's current tip.
+func (s *state) raceStart() {
+	m := &s.miners[s.attacker]
+	s.racepay = 0
+	s.racewon = 0
+	s.racehonest = 0
+	for mi := range s.miners {
+		p := &s.miners[mi]
+		if p.active && !p.selfish && mi != s.attacker &&
+			s.getheight(p.tip) > s.racehonest {
+			s.racehonest = s.getheight(p.tip)
 		}
 	}
-	newbaseblockid := blockAtSameHeight[0]
+	m.pubheight = s.getheight(m.tip)
+	heap.Push(&s.eventlist, event{
+		to:   s.attacker,
+		kind: raceDeadline,
+		when: s.currenttime + s.racedeadline,
+		bid:  blockid(s.races)})
+	s.trace(s.attacker, "%.3f %s race-start %d on %d\n", s.currenttime, m.name,
+		s.races, m.tip)
+}
 
-	// Give credits to miners (these blocks can't be reorged away).
-	b := getblock(newbaseblockid)
-	for b != &g.blocks[0] {
-		g.miners[b.miner].credit++
-		b = getblock(b.parent)
+// An honest miner has just started mining on bid, which it mined (if
+// mined is true) or received.
+func (s *state) raceHonest(bid blockid, mined bool) {
+	h := s.getheight(bid)
+	if mined && s.racepay == 0 {
+		s.racepay = h
 	}
-	// Increment the number of blocks mined per miner.
-	for i := blockid(0); i < newbaseblockid-g.baseblockid; i++ {
-		b := g.blocks[i]
-		// don't include the genesis block
-		if b.height > 0 {
-			g.mined++
-		}
+	if h > s.racehonest {
+		s.racehonest = h
+		s.raceCheck()
 	}
+}
 
-	// Remove older blocks that are no longer relevant.
-	g.blocks = g.blocks[newbaseblockid-g.baseblockid:]
-	g.baseblockid = newbaseblockid
+// The attacker (mi) received an honest block; it doesn't switch to it,
+// but it relays it as an honest miner would (so as not to look suspicious).
+func (s *state) raceReceived(mi int, bid blockid, from int) {
+	m := &s.miners[mi]
+	if s.getheight(bid) <= m.pubheight {
+		return
+	}
+	m.pubheight = s.getheight(bid)
+	s.relay(mi, bid, true, from)
 }
 
-func main() {
-	flag.Parse()
-	var err error
-	networkfile, err := os.Open(g.network)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "open failed:", err)
-		os.Exit(1)
+// Check whether the attacker has won (for more confirmations).
+func (s *state) raceCheck() {
+	if s.racepay == 0 {
+		// The payment hasn't been mined yet.
+		return
 	}
-	if g.traceenable {
-		g.trace = fmt.Printf
+	private := s.getheight(s.miners[s.attacker].tip)
+	if private <= s.racehonest {
+		return
 	}
-	if g.seed == -1 {
-		g.seed = time.Now().UnixNano()
+	d := int(s.racehonest - s.racepay + 1)
+	if d > s.doublespend {
+		d = s.doublespend
 	}
-	if g.seed > 0 {
-		rand.Seed(g.seed)
+	if d > s.racewon {
+		s.racewon = d
+		s.trace(s.attacker, "%.3f %s race-won %d confirmations\n", s.currenttime,
+			s.miners[s.attacker].name, d)
 	}
-	minerMap := make(map[string][]string, 0)
-	minerIndex := make(map[string]int, 0)
-	i := 0
-	scan := bufio.NewScanner(networkfile)
-	for scan.Scan() { // each line
-		// Each line is a miner name, hashrate, then a list of pairs of
-		// peer name and delay (time to send to that peer)
-		fields := strings.Fields(scan.Text())
-		if len(fields) == 0 {
-			continue
+	if s.racewon == s.doublespend {
+		s.raceEnd()
+	}
+}
+
+// The current race is over; record the result, and have the attacker
+// give up its private chain and start again from the best honest tip.
+func (s *state) raceEnd() {
+	for d := 1; d <= s.racewon; d++ {
+		s.raceswon[d]++
+	}
+	s.races++
+	best := s.baseblockid
+	for mi := range s.miners {
+		p := &s.miners[mi]
+		if p.active && !p.selfish && mi != s.attacker &&
+			s.getheight(p.tip) > s.getheight(best) {
+			best = p.tip
 		}
-		if fields[0] == "#" {
+	}
+	s.startMining(s.attacker, best)
+	if s.races < s.attempts {
+		s.raceStart()
+	}
+}
+
+// Return a random time for miner m to solve a block of the given difficulty.
+func (s *state) solveTime(m *miner, difficulty float64) float64 {
+	switch s.dist {
+	case deterministic:
+		return difficulty / m.hashrate
+	case lognormal:
+		// The underlying normal has mean -sigma^2/2 so that the
+		// lognormal mean is one.
+		return math.Exp(s.sigma*m.r.NormFloat64()-s.sigma*s.sigma/2) *
+			difficulty / m.hashrate
+	}
+	return -math.Log(1.0-m.r.Float64()) *
+		difficulty / m.hashrate
+}
+
+// Return true if a currently-active partition separates these miners.
+func (s *state) partitioned(from, to int) bool {
+	for _, pt := range s.partitions {
+		if s.currenttime >= pt.start && s.currenttime < pt.end &&
+			pt.side[from] != 0 && pt.side[to] != 0 &&
+			pt.side[from] != pt.side[to] {
+			return true
+		}
+	}
+	return false
+}
+
+// The partition has ended; miners on each side with peers on the other side
+// now (re)send their best blocks across, as reconnecting nodes would.
+func (s *state) heal(pi int) {
+	pt := &s.partitions[pi]
+	s.trace(-1, "%.3f partition %d heal\n", s.currenttime, pi)
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		if !m.active || m.selfish || pt.side[mi] == 0 {
+			// A selfish miner will publish as needed anyway.
 			continue
 		}
-		if _, ok := minerMap[fields[0]]; ok {
-			fmt.Fprintln(os.Stderr, "duplicate miner name:", fields[0])
-			os.Exit(1)
+		for _, p := range m.peers {
+			if pt.side[p.miner] != 0 && pt.side[p.miner] != pt.side[mi] {
+				s.relay(mi, m.tip, false, -1)
+				break
+			}
 		}
-		minerMap[fields[0]] = fields[1:]
-		minerIndex[fields[0]] = i
-		i++
 	}
-	if len(minerMap) == 0 {
-		fmt.Fprintln(os.Stderr, "no miners")
-		os.Exit(1)
+}
+
+// A miner has reorged away the block lost, in favor of won (on the branch
+// it's switching to); count this for -reorg-matrix.
+func (s *state) displace(lost, won *block) {
+	if s.displaced != nil {
+		s.displaced[lost.miner][won.miner]++
 	}
+}
 
-	// Set up (static) set of miners.
-	g.miners = make([]miner, i)
-	for k, v := range minerMap {
-		// v is a slice of whitespace-separated tokens (on a line)
-		hr, err := strconv.Atoi(v[0])
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "bad hashrate:", v[0], err)
-			os.Exit(1)
-		}
-		if hr <= 0 {
-			fmt.Fprintln(os.Stderr, "hashrate must be greater than zero:", v[0])
-			os.Exit(1)
+// Return true if (non-selfish) miner mi should switch to the received block.
+func (s *state) better(mi int, bid blockid) bool {
+	m := &s.miners[mi]
+	if s.ghost {
+		return s.ghostBetter(mi, bid)
+	}
+	h, current := s.getheight(bid), s.getheight(m.tip)
+	if h != current || bid == m.tip {
+		return h > current
+	}
+	return !s.tied(mi, bid) && s.tie(s.getblock(m.tip), s.getblock(bid))
+}
+
+// Return true if the branch of block bid forks from our tip's chain below
+// the base block (the fork point has been pruned).
+func (s *state) forksBelowBase(tip, bid blockid) bool {
+	t, c := s.getblock(bid), s.getblock(tip)
+	if t.height < s.blocks[0].height {
+		return true
+	}
+	for t.height > c.height {
+		if !s.validblock(t.parent) {
+			return true
 		}
-		g.totalhash += hr
-		m := miner{hashrate: hr}
-		m.name = k
-		m.index = minerIndex[k]
-		v = v[1:]
-		if (len(v) % 2) > 0 {
-			fmt.Fprintln(os.Stderr, "bad peer delay pairs:", k, v)
-			os.Exit(1)
+		t = s.getblock(t.parent)
+	}
+	for c.height > t.height {
+		c = s.getblock(c.parent)
+	}
+	for t != c && t.height > 0 {
+		if !s.validblock(t.parent) || c == &s.blocks[0] {
+			// (All tips descend from blocks[0] or a genesis block.)
+			return true
 		}
-		for len(v) > 0 {
-			if _, ok := minerIndex[v[0]]; !ok {
-				fmt.Fprintln(os.Stderr, "no such miner:", v[0])
-				os.Exit(1)
-			}
-			delay, err := strconv.ParseFloat(v[1], 64)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "bad delay:", v[1], err)
-				os.Exit(1)
+		t, c = s.getblock(t.parent), s.getblock(c.parent)
+	}
+	return false
+}
+
+// Relay a block from miner mi and the other active members of its pool
+// (none of them to from, which sent it to mi).
+func (s *state) relayPool(mi int, bid blockid, received bool, from int) {
+	if pi := s.miners[mi].pool; pi >= 0 {
+		for _, pm := range s.pools[pi].members {
+			if pm != mi && s.miners[pm].active {
+				s.relay(pm, bid, received, from)
 			}
-			m.peers = append(m.peers, peer{minerIndex[v[0]], delay})
-			v = v[2:]
 		}
-		g.miners[m.index] = m
 	}
+	s.relay(mi, bid, received, from)
+}
 
-	// Start all miners off mining their first blocks.
-	for mi := range g.miners {
-		// Begin mining on blockid 1 (our genesis block, height zero).
-		startMining(mi, g.baseblockid)
+// Return true if we should switch from current to the received block (of
+// the same height) according to the tiebreak rule.
+func (s *state) tie(current, received *block) bool {
+	switch s.tiebreak {
+	case lastSeen:
+		return true
+	case randomTie:
+		return s.choice("tie", -1, boolFloat(s.r.Float64() < 0.5)) != 0
+	case hashrateTie:
+		c, r := s.hashrateOn(current), s.hashrateOn(received)
+		if r == 0 {
+			return false
+		}
+		return s.choice("tie", -1,
+			boolFloat(s.r.Float64()*(c+r) < r)) != 0
 	}
+	return false
+}
 
-	// Main event loop
-	for g.maxHeight < height(g.stopheight) {
-		if g.maxHeight%10000 == 0 {
-			cleanBlocks()
+// Return the total hashrate of the active miners whose tips are b or its
+// descendants (an idealized tiebreak: a real miner doesn't know this).
+func (s *state) hashrateOn(b *block) float64 {
+	var hashrate float64
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		if !m.active {
+			continue
 		}
-		ev := heap.Pop(&g.eventlist).(event)
-		g.currenttime = ev.when
-		mi := ev.to
-		m := &g.miners[mi]
-		height := getheight(m.tip)
-		if ev.mining {
-			// We mined a block (unless this is a stale event).
-			if ev.bid != m.tip {
-				// This is a stale mining event, ignore it (we should
-				// still have an active mining event outstanding).
+		t := s.getblock(m.tip)
+		for t.height > b.height {
+			t = s.getblock(t.parent)
+		}
+		if t == b {
+			hashrate += m.hashrate
+		}
+	}
+	return hashrate
+}
+
+// GHOST fork choice (greedy heaviest observed subtree): at the block where
+// the received block's branch and our tip's branch fork, go toward the
+// child whose subtree has more blocks that we've seen. A branch that forks
+// at or below ghostfloor is stale: every active miner had moved past it.
+func (s *state) ghostBetter(mi int, bid blockid) bool {
+	m := &s.miners[mi]
+	if bid == m.tip {
+		return false
+	}
+	// ts and cs become the children of the fork block on each side.
+	var ts, cs *block
+	t, c := s.getblock(bid), s.getblock(m.tip)
+	if t.height < s.blocks[0].height {
+		return false
+	}
+	// If the received block's branch forks from a block that's already
+	// been pruned, it's a stale branch.
+	for t.height > c.height {
+		if !s.validblock(t.parent) {
+			return false
+		}
+		ts, t = t, s.getblock(t.parent)
+	}
+	for c.height > t.height {
+		cs, c = c, s.getblock(c.parent)
+	}
+	for t != c {
+		if t.height == 0 {
+			// Different genesis blocks; compare the whole trees.
+			ts, cs = t, c
+			break
+		}
+		if !s.validblock(t.parent) || c == &s.blocks[0] {
+			// (All tips descend from blocks[0] or a genesis block.)
+			return false
+		}
+		ts, t = t, s.getblock(t.parent)
+		cs, c = c, s.getblock(c.parent)
+	}
+	if ts == nil {
+		// The received block is an ancestor of our tip.
+		return false
+	}
+	if cs == nil {
+		// The received block extends our tip.
+		return true
+	}
+	if s.ghostfloor > 0 && ts.height <= s.ghostfloor {
+		// (The weights aren't kept down there, see see().)
+		return false
+	}
+	if ts.weights[mi] != cs.weights[mi] {
+		return ts.weights[mi] > cs.weights[mi]
+	}
+	return !s.tied(mi, bid) && s.tie(cs, ts)
+}
+
+// Return true if miner mi has mined on block bid or already broken a tie
+// with it, and note that it has now. Otherwise, under a tiebreak that can
+// switch, each copy of a block arriving from another peer would be a new
+// tie, and the miners would flip between equal tips indefinitely.
+func (s *state) tied(mi int, bid blockid) bool {
+	b := s.getblock(bid)
+	if b.seen == nil {
+		// (A first-seen tiebreak never switches.)
+		return false
+	}
+	if b.seen[mi] {
+		return true
+	}
+	b.seen[mi] = true
+	return false
+}
+
+// Miner mi has seen block bid (mined or received it, or its header), and so
+// its ancestors; add the ones it hadn't seen to its weights (for -ghost) of
+// their ancestors. Forks at or below ghostfloor don't matter (see
+// ghostBetter()), so the weights there aren't needed, and this walks back
+// only to ghostfloor, the greatest height the finalized block has had (or,
+// before it's above zero, to the genesis block), rather than to the base.
+func (s *state) see(mi int, bid blockid) {
+	if s.final != 0 && s.getheight(s.final) > s.ghostfloor {
+		s.ghostfloor = s.getheight(s.final)
+	}
+	b := s.getblock(bid)
+	if b.weights[mi] > 0 {
+		// Seen already, and so were its ancestors.
+		return
+	}
+	// The number of blocks, on the way back from bid, that mi hadn't seen.
+	added := 0
+	for {
+		if b.weights[mi] == 0 {
+			added++
+		}
+		b.weights[mi] += added
+		if !s.validblock(b.parent) {
+			break
+		}
+		b = s.getblock(b.parent)
+		if s.ghostfloor > 0 && b.height <= s.ghostfloor {
+			break
+		}
+	}
+}
+
+// Start mining on top of the given existing block
+func (s *state) startMining(mi int, bid blockid) {
+	m := &s.miners[mi]
+	if m.active {
+		// (An inactive miner's tip isn't counted, see activate().)
+		s.moveTip(m.tip, bid)
+	}
+	// We'll mine on top of blockid
+	m.tip = bid
+	s.tied(mi, bid) // (a copy arriving later isn't a tie)
+	if s.ghost {
+		s.see(mi, bid)
+	}
+	if s.propagation {
+		s.adopt(mi, bid)
+	}
+	if s.k > 0 && !m.selfish && !s.racing(mi) {
+		s.confirm(bid)
+	}
+
+	// Schedule an event for when our "mining" will be done.
+	solvetime := s.choice("solve", mi,
+		s.solveTime(m, s.getblock(bid).difficulty))
+	m.solveat = s.currenttime + solvetime
+
+	heap.Push(&s.eventlist, event{
+		to:   mi,
+		kind: blockMined,
+		when: m.solveat,
+		bid:  bid})
+	s.trace(mi, "%.3f %s start-on %d height %d mined %d credit %d solve %.2f\n",
+		s.currenttime, m.name, bid, s.getheight(bid),
+		m.mined, m.credit, solvetime)
+}
+
+// An active miner's tip moves from one block to another; update the tip
+// counts of the blocks on both branches, back to where they meet, and the
+// finalized block (the newest one that all active miners' tips descend
+// from), which can only change to a block on one of these branches. Mining
+// a block moves a tip just one block, so this is usually quick.
+func (s *state) moveTip(from, to blockid) {
+	var newfinal blockid
+	passed := false
+	add := func(bid blockid) {
+		b := s.getblock(bid)
+		b.tips++
+		if newfinal == 0 && b.tips == s.nactive {
+			// The first (newest) block that every tip is on.
+			newfinal = bid
+		}
+	}
+	remove := func(bid blockid) {
+		s.getblock(bid).tips--
+		if bid == s.final {
+			passed = true
+		}
+	}
+	for s.getheight(to) > s.getheight(from) {
+		add(to)
+		to = s.getblock(to).parent
+	}
+	for s.getheight(from) > s.getheight(to) {
+		remove(from)
+		from = s.getblock(from).parent
+	}
+	for from != to {
+		add(to)
+		remove(from)
+		if s.getheight(to) == 0 {
+			// Different genesis blocks (see "genesis").
+			break
+		}
+		to = s.getblock(to).parent
+		from = s.getblock(from).parent
+	}
+	switch {
+	case newfinal != 0:
+		s.final = newfinal
+	case passed && from == to:
+		// The new tip branches off below the old finalized block.
+		s.final = from
+	case passed:
+		s.final = 0
+	}
+}
+
+// Add n to the tip counts of block bid and its ancestors (back to the
+// base block or a genesis block), for a miner joining or leaving.
+func (s *state) addTips(bid blockid, n int) {
+	for b := s.getblock(bid); ; b = s.getblock(b.parent) {
+		b.tips += n
+		if !s.validblock(b.parent) {
+			break
+		}
+	}
+}
+
+// Set the finalized block (see moveTip()) by searching back from the
+// given active miner's tip, after a miner joins or leaves.
+func (s *state) findFinal(bid blockid) {
+	s.final = 0
+	for s.getblock(bid).tips != s.nactive {
+		if !s.validblock(s.getblock(bid).parent) {
+			// The tips descend from different genesis blocks.
+			return
+		}
+		bid = s.getblock(bid).parent
+	}
+	s.final = bid
+}
+
+// Miner mi has become active, mining on bid (its tip wasn't counted while
+// it was inactive).
+func (s *state) activate(mi int, bid blockid) {
+	s.miners[mi].tip = bid
+	s.nactive++
+	s.addTips(bid, 1)
+	s.findFinal(bid)
+}
+
+// Miner mi is now mining on bid; it has adopted this block and its
+// ancestors, if it hadn't already (for -propagation).
+func (s *state) adopt(mi int, bid blockid) {
+	b := s.getblock(bid)
+	for b.adopters != nil && !b.adopters[mi] {
+		b.adopters[mi] = true
+		b.waiting--
+		if b.waiting == 0 {
+			b.propagated = s.currenttime - s.trueTime(b)
+		}
+		if !s.validblock(b.parent) {
+			break
+		}
+		b = s.getblock(b.parent)
+	}
+}
+
+// The given block is now at the tip of some miner's chain; update the
+// confirmation count of it and its ancestors (up to k deep).
+func (s *state) confirm(bid blockid) {
+	b := s.getblock(bid)
+	for d := 1; d <= s.k; d++ {
+		if b.confirms < d {
+			b.confirms = d
+		}
+		if !s.validblock(b.parent) {
+			break
+		}
+		b = s.getblock(b.parent)
+	}
+}
+
+// Set the difficulty of a newly-mined block b, whose parent is p, adjusting
+// it (as Bitcoin does) at the end of each retarget period so that the period
+// would have taken the expected time, but by no more than a factor of 4.
+func (s *state) retargetBlock(b, p *block) {
+	b.difficulty = p.difficulty
+	b.periodstart = p.periodstart
+	if s.retarget == 0 || b.height%height(s.retarget) != 0 {
+		return
+	}
+	// Block times are timestamps (see skew), so elapsed can be negative.
+	expected := float64(s.retarget * s.blockinterval)
+	elapsed := b.time - b.periodstart
+	if elapsed < expected/4 {
+		elapsed = expected / 4
+	}
+	if elapsed > expected*4 {
+		elapsed = expected * 4
+	}
+	ratio := expected / elapsed
+	b.difficulty *= ratio
+	b.periodstart = b.time
+	s.trace(-1, "%.3f retarget height %d ratio %.4f interval %.3f\n",
+		s.currenttime, b.height, ratio, b.difficulty/s.basehash)
+}
+
+// Remove un-needed blocks (those below the finalized block, see moveTip()),
+// give credits to miners. Only active miners' tips are considered; inactive
+// miners' tips may be removed.
+func (s *state) cleanBlocks() {
+	if s.final == 0 {
+		// No active miners, or their tips descend from different
+		// genesis blocks (they haven't been connected yet).
+		return
+	}
+	newbaseblockid := s.final
+
+	// Give credits to miners (these blocks can't be reorged away).
+	b := s.getblock(newbaseblockid)
+	for b != &s.blocks[0] && b.height > 0 {
+		b.best = true
+		if s.retarget > 0 && b.height%height(s.retarget) == 0 {
+			s.retargets++
+		}
+		p := s.getblock(b.parent)
+		if b.height < s.warmup {
+			// Not counted (see -warmup); the average block time
+			// starts from the last of these.
+			if b.height == s.warmup-1 {
+				s.warmuptime = s.trueTime(b)
+			}
+			b = p
+			continue
+		}
+		s.miners[b.miner].credit++
+		s.miners[b.miner].revenue += s.subsidy + b.fee
+		if b.adopters != nil && b.waiting == 0 {
+			s.proptimes = append(s.proptimes, b.propagated)
+		}
+		// Best-chain blocks' confirmations are counted by stats().
+		for d := 1; d <= s.k && d <= b.reversed; d++ {
+			s.reversals[d]++
+		}
+		if s.buckets > 0 {
+			i := int((b.time - p.time) / s.buckets)
+			if i < 0 {
+				i = 0 // possible with clock skew
+			}
+			for len(s.intervals) <= i {
+				s.intervals = append(s.intervals, 0)
+			}
+			s.intervals[i]++
+		}
+		b = p
+	}
+	b.best = true // (may be the genesis block that won)
+	// Blocks up to the new base block are now known to be either on the
+	// best chain or stale; blocks[0] was done when it became the base
+	// block, unless it's the (default) genesis block, whose chain may
+	// have lost to another genesis block's.
+	first := blockid(1)
+	if s.blocks[0].height == 0 {
+		first = 0
+	}
+	for i := first; i <= newbaseblockid-s.baseblockid; i++ {
+		b := &s.blocks[i]
+		// Count the blocks mined, total and per miner, not including
+		// genesis blocks or warmup blocks.
+		if b.height >= s.warmup {
+			s.mined++
+			s.miners[b.miner].mined++
+		}
+		if s.csvlog != nil && b.height > 0 {
+			s.logBlock(s.baseblockid+i, b, strconv.FormatBool(b.best))
+		}
+		if s.tree != nil && !b.best {
+			fmt.Fprintf(s.tree, "  %d [style=dashed color=red];\n",
+				s.baseblockid+i)
+		}
+		if b.height == 0 {
+			// A genesis block (see "genesis"), not mined; if its
+			// chain lost, none of that chain's blocks are uncles.
+			if !b.best {
+				b.above = s.uncledepth
+			}
+			continue
+		}
+		if s.uncledepth > 0 && !b.best {
+			// A stale block is an uncle if it's at most uncledepth
+			// blocks above the best-chain block its branch forks
+			// from (so with uncledepth 1, only direct children of
+			// best-chain blocks count). If its parent has already
+			// been removed, this was set then (see below).
+			if s.validblock(b.parent) {
+				b.above = s.getblock(b.parent).above + 1
+			}
+			if b.above <= s.uncledepth && b.height >= s.warmup {
+				s.uncles++
+				s.miners[b.miner].uncles++
+			}
+		}
+		if b.height < s.warmup {
+			continue
+		}
+		// No miner is mining on this stale block's branch any more, so
+		// its confirmation and reversal counts are final.
+		for d := 1; d <= s.k && d <= b.confirms && !b.best; d++ {
+			s.confirmed[d]++
+			if b.reversed >= d {
+				s.reversals[d]++
+			}
+		}
+	}
+	if s.uncledepth > 0 {
+		// Remaining blocks whose parents are about to be removed.
+		for i := newbaseblockid - s.baseblockid + 1; i < blockid(len(s.blocks)); i++ {
+			b := &s.blocks[i]
+			if s.validblock(b.parent) && b.parent < newbaseblockid {
+				b.above = s.getblock(b.parent).above + 1
+			}
+		}
+	}
+
+	// Remove older blocks that are no longer relevant.
+	s.blocks = s.blocks[newbaseblockid-s.baseblockid:]
+	s.baseblockid = newbaseblockid
+}
+
+// Add a newly-mined block to the block tree.
+func (s *state) treeBlock(bid blockid, b *block) {
+	fmt.Fprintf(s.tree, "  %d [label=\"%d %s\\nheight %d\\n%.3f\"];\n",
+		bid, bid, s.miners[b.miner].name, b.height, b.time)
+	fmt.Fprintf(s.tree, "  %d -> %d;\n", b.parent, bid)
+}
+
+// Miner mi joins the network; it instantly syncs to the best chain that its
+// active inbound peers (and pool members) have.
+func (s *state) join(mi int) {
+	m := &s.miners[mi]
+	s.accrue(m)
+	m.active = true
+	s.totalhash += m.hashrate
+	best := s.baseblockid
+	if g := s.baseblockid + blockid(m.genesis); g > best && s.validblock(g) {
+		// Our genesis block's chain hasn't been connected yet.
+		best = g
+	}
+	for pi := range s.miners {
+		p := &s.miners[pi]
+		if !p.active || pi == mi || s.racing(pi) {
+			continue
+		}
+		if m.pool < 0 || p.pool != m.pool {
+			inbound := false
+			for _, pp := range p.peers {
+				if pp.miner == mi {
+					inbound = true
+				}
+			}
+			if !inbound {
 				continue
 			}
-			m.mined++
-			ev.bid = g.baseblockid + blockid(len(g.blocks))
-			height++
-			if g.maxHeight < height {
-				g.maxHeight = height
+		}
+		tip := p.tip
+		if p.selfish {
+			// Only the public part of its chain.
+			for s.getheight(tip) > p.pubheight {
+				tip = s.getblock(tip).parent
 			}
-			g.blocks = append(g.blocks, block{
-				parent: m.tip,
-				height: height,
-				miner:  mi,
-				time:   g.currenttime,
-			})
-			g.trace("%.3f %s mined-newid %d on %d height %d\n",
-				g.currenttime, m.name, ev.bid, m.tip, height)
-		} else {
-			// Block received from a peer (but could be a stale message).
-			if !validblock(ev.bid) || getheight(ev.bid) <= height {
-				// We're already mining on a block that's at least as good.
+		}
+		if s.getheight(tip) > s.getheight(best) {
+			best = tip
+		}
+	}
+	m.pubheight = s.getheight(best)
+	s.trace(mi, "%.3f %s join totalhash %g\n", s.currenttime, m.name, s.totalhash)
+	s.activate(mi, best)
+	s.startMining(mi, best)
+}
+
+// Miner mi leaves the network; its outstanding mining event will be ignored.
+func (s *state) leave(mi int) {
+	m := &s.miners[mi]
+	s.accrue(m)
+	m.active = false
+	s.totalhash -= m.hashrate
+	s.nactive--
+	s.addTips(m.tip, -1)
+	s.final = 0 // (if no miners are active)
+	for pi := range s.miners {
+		if s.miners[pi].active {
+			s.findFinal(s.miners[pi].tip)
+			break
+		}
+	}
+	s.trace(mi, "%.3f %s leave totalhash %g\n", s.currenttime, m.name, s.totalhash)
+}
+
+// Miner mi's hashrate changes. Since solve time is proportional to work,
+// the remaining time of its current mining event scales by the ratio of
+// the old and new hashrates (for the exponential distribution, this is
+// the same as drawing a new solve time, since it's memoryless).
+func (s *state) setHashrate(mi int, hashrate float64) {
+	m := &s.miners[mi]
+	s.accrue(m)
+	old := m.hashrate
+	m.hashrate = hashrate
+	if !m.active {
+		return
+	}
+	s.totalhash += hashrate - old
+	s.trace(mi, "%.3f %s hashrate %g totalhash %g\n",
+		s.currenttime, m.name, hashrate, s.totalhash)
+	m.solveat = s.currenttime +
+		(m.solveat-s.currenttime)*old/hashrate
+	heap.Push(&s.eventlist, event{
+		to:   mi,
+		kind: blockMined,
+		when: m.solveat,
+		bid:  m.tip})
+}
+
+// Add the miner's (active) hashrate since the last call to its total.
+func (s *state) accrue(m *miner) {
+	if m.active {
+		m.hashwork += m.hashrate * (s.currenttime - m.hashsince)
+	}
+	m.hashsince = s.currenttime
+}
+
+// Write a CSV row for a block that's about to be pruned, or (best is
+// "unknown") that's still unsettled at the end of the run.
+func (s *state) logBlock(bid blockid, b *block, best string) {
+	s.csvlog.Write([]string{
+		strconv.FormatInt(int64(bid), 10),
+		strconv.FormatInt(int64(b.height), 10),
+		strconv.Itoa(b.miner),
+		s.miners[b.miner].name,
+		strconv.FormatInt(int64(b.parent), 10),
+		strconv.FormatFloat(b.time, 'f', 3, 64),
+		best,
+	})
+}
+
+// At the end of the run, log the blocks that cleanBlocks() has left, those
+// above the base block; they're not known to be on the best chain or stale.
+func (s *state) logUnsettled() {
+	for i := 1; i < len(s.blocks); i++ {
+		b := &s.blocks[i]
+		if b.height == 0 {
+			continue // a genesis block (see "genesis")
+		}
+		bid := s.baseblockid + blockid(i)
+		if s.csvlog != nil {
+			s.logBlock(bid, b, "unknown")
+		}
+		if s.tree != nil {
+			fmt.Fprintf(s.tree, "  %d [style=dotted];\n", bid)
+		}
+	}
+}
+
+// Read the lines of a topology file, replacing each "include path" line
+// with the (recursively expanded) lines of that file. A relative path is
+// relative to dir, the directory of the file containing the include; stack
+// is the chain of files currently being included, to detect cycles.
+func readTopology(r io.Reader, dir string, stack []string) ([]string, error) {
+	var lines []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 || fields[0] != "include" {
+			lines = append(lines, scan.Text())
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad include: %s", scan.Text())
+		}
+		path := fields[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range stack {
+			if p == abs {
+				return nil, fmt.Errorf("include cycle: %s", path)
+			}
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		included, err := readTopology(f, filepath.Dir(path), append(stack, abs))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, included...)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Parse the network topology, one line per miner; relative include paths
+// are relative to dir.
+func parseNetwork(r io.Reader, dir string) (*network, error) {
+	minerMap := make(map[string][]string, 0)
+	minerIndex := make(map[string]int, 0)
+	var partitionLines [][]string
+	i := 0
+	lines, err := readTopology(r, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		// Each line is a miner name, hashrate, then a list of pairs of
+		// peer name and delay (time to send to that peer)
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "#" {
+			continue
+		}
+		if fields[0] == "partition" {
+			// These may refer to miners defined later.
+			partitionLines = append(partitionLines, fields[1:])
+			continue
+		}
+		if _, ok := minerMap[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate miner name: %s", fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing hashrate: %s", fields[0])
+		}
+		minerMap[fields[0]] = fields[1:]
+		minerIndex[fields[0]] = i
+		i++
+	}
+	if len(minerMap) == 0 {
+		return nil, errors.New("no miners")
+	}
+
+	// Set up (static) set of miners.
+	miners := make([]miner, i)
+	for k, v := range minerMap {
+		// v is a slice of whitespace-separated tokens (on a line)
+		hr, err := strconv.ParseFloat(v[0], 64)
+		if err != nil || math.IsNaN(hr) || math.IsInf(hr, 0) {
+			return nil, fmt.Errorf("bad hashrate: %s", v[0])
+		}
+		if hr <= 0 {
+			return nil, fmt.Errorf("hashrate must be greater than zero: %s", v[0])
+		}
+		m := miner{hashrate: hr, validation: -1}
+		m.name = k
+		m.index = minerIndex[k]
+		v = v[1:]
+		for len(v) > 0 {
+			// Keywords may appear anywhere among the peer delay pairs.
+			switch v[0] {
+			case "selfish":
+				m.selfish = true
+				v = v[1:]
+				continue
+			case "attacker":
+				m.attacker = true
+				v = v[1:]
+				continue
+			case "size":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing block size: %s", k)
+				}
+				size, err := strconv.Atoi(v[1])
+				if err != nil || size < 0 {
+					return nil, fmt.Errorf("bad block size: %s %s", k, v[1])
+				}
+				m.size = size
+				v = v[2:]
+				continue
+			case "joinat", "leaveat":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing %s time: %s", v[0], k)
+				}
+				t, err := strconv.ParseFloat(v[1], 64)
+				if err != nil || t < 0 {
+					return nil, fmt.Errorf("bad %s time: %s %s", v[0], k, v[1])
+				}
+				if v[0] == "joinat" {
+					m.joinat = t
+				} else {
+					m.leaveat = t
+				}
+				v = v[2:]
+				continue
+			case "hashrate-at":
+				if len(v) < 3 {
+					return nil, fmt.Errorf("missing hashrate-at time or hashrate: %s", k)
+				}
+				t, err := strconv.ParseFloat(v[1], 64)
+				if err != nil || t < 0 {
+					return nil, fmt.Errorf("bad hashrate-at time: %s %s", k, v[1])
+				}
+				hr, err := strconv.ParseFloat(v[2], 64)
+				if err != nil || !(hr > 0) || math.IsInf(hr, 0) {
+					return nil, fmt.Errorf("bad hashrate-at hashrate: %s %s", k, v[2])
+				}
+				m.schedule = append(m.schedule, hashChange{t, hr})
+				v = v[3:]
+				continue
+			case "skew":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing clock skew: %s", k)
+				}
+				t, err := strconv.ParseFloat(v[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad clock skew: %s %s", k, v[1])
+				}
+				m.skew = t
+				v = v[2:]
+				continue
+			case "validation":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing validation time: %s", k)
+				}
+				t, err := strconv.ParseFloat(v[1], 64)
+				if err != nil || t < 0 {
+					return nil, fmt.Errorf("bad validation time: %s %s", k, v[1])
+				}
+				m.validation = t
+				v = v[2:]
+				continue
+			case "pool":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing pool name: %s", k)
+				}
+				m.poolname = v[1]
+				v = v[2:]
+				continue
+			case "genesis":
+				if len(v) < 2 {
+					return nil, fmt.Errorf("missing genesis name: %s", k)
+				}
+				m.genesisname = v[1]
+				v = v[2:]
 				continue
 			}
-			// This block is better, switch to it, first compute reorg depth.
-			g.trace("%.3f %s received-switch-to %d\n",
-				g.currenttime, m.name, ev.bid)
-			c := getblock(m.tip)  // current block we're mining on
-			t := getblock(ev.bid) // to block (switching to)
-			// Move back on the "to" (better) chain until even with current.
-			for t.height > c.height {
-				t = getblock(t.parent)
+			if len(v) < 2 {
+				return nil, fmt.Errorf("bad peer delay pairs: %s %v", k, v)
 			}
-			// From the same height, count blocks until these branches meet.
-			reorg := 0
-			for t != c {
-				reorg++
-				t = getblock(t.parent)
-				c = getblock(c.parent)
+			if _, ok := minerIndex[v[0]]; !ok {
+				return nil, fmt.Errorf("no such miner: %s", v[0])
 			}
-			if reorg > 0 {
-				g.trace("%.3f %s reorg %d maxreorg %d\n",
-					g.currenttime, m.name, reorg, g.maxreorg)
-			}
-			if g.maxreorg < reorg {
-				g.maxreorg = reorg
-			}
-		}
-		relay(mi, ev.bid)
-		startMining(mi, ev.bid)
-	}
-	cleanBlocks()
-	var bestchainblocks height = g.blocks[0].height
-	var staleblocks height = g.mined - bestchainblocks
-	fmt.Printf("%-20s %14d\n", "seed-arg", g.seed)
-	fmt.Printf("%-20s %14d\n", "block-interval-arg", g.blockinterval)
-	fmt.Printf("%-20s %14d\n", "stopheight-arg", g.stopheight)
-	fmt.Printf("%-20s %14d\n", "total-hashrate-arg", g.totalhash)
-	fmt.Printf("%-20s %14d\n", "mined-blocks", g.mined)
-	fmt.Printf("%-20s %14.3f\n", "total-simtime", g.blocks[0].time)
-	fmt.Printf("%-20s %14.3f\n", "ave-block-time",
-		float64(g.blocks[0].time)/float64(bestchainblocks))
-	fmt.Printf("%-20s %14d\n", "stale-blocks", staleblocks)
-	fmt.Printf("%-20s %14.2f%%\n", "stale-rate",
-		float64(staleblocks*100)/float64(g.mined))
-	fmt.Printf("%-20s %14d\n", "max-reorg-depth", g.maxreorg)
-	for _, m := range g.miners {
-		fmt.Printf("miner %-13s  hashrate-arg %6d %6.2f%% ", m.name,
-			m.hashrate, float64(m.hashrate*100)/float64(g.totalhash))
-		fmt.Printf("blocks %6.2f%% ",
-			float64(m.credit*100)/float64(bestchainblocks))
-		fmt.Printf("stale-rate %6.2f%%",
-			float64((m.mined-m.credit)*100)/float64(m.mined))
-		fmt.Println("")
+			delay, err := strconv.ParseFloat(v[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad delay: %s %v", v[1], err)
+			}
+			m.peers = append(m.peers, peer{minerIndex[v[0]], delay})
+			v = v[2:]
+		}
+		if m.leaveat > 0 && m.leaveat <= m.joinat {
+			return nil, fmt.Errorf("leaveat must be after joinat: %s", k)
+		}
+		sort.Slice(m.schedule, func(i, j int) bool {
+			return m.schedule[i].when < m.schedule[j].when
+		})
+		for i := 1; i < len(m.schedule); i++ {
+			if m.schedule[i].when == m.schedule[i-1].when {
+				return nil, fmt.Errorf("duplicate hashrate-at time: %s %v",
+					k, m.schedule[i].when)
+			}
+		}
+		if m.selfish && m.poolname != "" {
+			return nil, fmt.Errorf("selfish miner can't be in a pool: %s", k)
+		}
+		if m.attacker && (m.selfish || m.poolname != "" ||
+			m.joinat > 0 || m.leaveat > 0) {
+			return nil, fmt.Errorf("attacker miner can't be selfish, "+
+				"in a pool, or join or leave: %s", k)
+		}
+		miners[m.index] = m
+	}
+	attackers := 0
+	for _, m := range miners {
+		if m.attacker {
+			attackers++
+		}
+	}
+	if attackers > 1 {
+		return nil, errors.New("more than one attacker miner")
+	}
+	poolGenesis := make(map[string]string)
+	for _, m := range miners {
+		if m.poolname == "" {
+			continue
+		}
+		if g, ok := poolGenesis[m.poolname]; ok && g != m.genesisname {
+			return nil, fmt.Errorf("pool members have different "+
+				"genesis blocks: %s", m.poolname)
+		}
+		poolGenesis[m.poolname] = m.genesisname
+	}
+	net := &network{miners: miners}
+	for _, v := range partitionLines {
+		pt, err := parsePartition(v, minerIndex)
+		if err != nil {
+			return nil, err
+		}
+		net.partitions = append(net.partitions, pt)
+	}
+	return net, nil
+}
+
+// Parse a latency-matrix topology: miner lines as in the network file
+// (usually just the name and hashrate), then a line containing only
+// "matrix", then one row per miner (in the same order) of the delays from
+// that miner to each miner; 0 or "-" means no connection.
+func parseMatrix(r io.Reader, dir string) (*network, error) {
+	var head strings.Builder
+	found := false
+	scan := bufio.NewScanner(r)
+	scan.Buffer(nil, 1<<24) // rows can be long
+	for scan.Scan() {
+		if strings.TrimSpace(scan.Text()) == "matrix" {
+			found = true
+			break
+		}
+		head.WriteString(scan.Text())
+		head.WriteByte('\n')
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("missing matrix line")
+	}
+	net, err := parseNetwork(strings.NewReader(head.String()), dir)
+	if err != nil {
+		return nil, err
+	}
+	n := len(net.miners)
+	row := 0
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 || fields[0] == "#" {
+			continue
+		}
+		if row >= n {
+			return nil, fmt.Errorf("more than %d matrix rows", n)
+		}
+		if len(fields) != n {
+			return nil, fmt.Errorf("matrix row %d (%s) has %d entries, "+
+				"expected %d", row+1, net.miners[row].name, len(fields), n)
+		}
+		for col, f := range fields {
+			if col == row || f == "-" {
+				continue
+			}
+			delay, err := strconv.ParseFloat(f, 64)
+			if err != nil || delay < 0 {
+				return nil, fmt.Errorf("bad delay: row %d column %d %s",
+					row+1, col+1, f)
+			}
+			if delay == 0 {
+				continue
+			}
+			net.miners[row].peers = append(net.miners[row].peers,
+				peer{col, delay})
+		}
+		row++
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if row < n {
+		return nil, fmt.Errorf("only %d matrix rows, expected %d", row, n)
+	}
+	return net, nil
+}
+
+// Make every peer connection two-way: for each A to B with delay d,
+// add B to A with delay d if it isn't already present. It's an error
+// if both directions are present but with different delays.
+func symmetrize(miners []miner) error {
+	delay := make(map[[2]int]float64)
+	for mi, m := range miners {
+		for _, p := range m.peers {
+			delay[[2]int{mi, p.miner}] = p.delay
+		}
+	}
+	for mi := range miners {
+		for _, p := range miners[mi].peers {
+			d, ok := delay[[2]int{p.miner, mi}]
+			if !ok {
+				delay[[2]int{p.miner, mi}] = p.delay
+				miners[p.miner].peers = append(miners[p.miner].peers,
+					peer{mi, p.delay})
+				continue
+			}
+			if d != p.delay {
+				return fmt.Errorf("conflicting delays: %s to %s %g, "+
+					"%s to %s %g", miners[mi].name, miners[p.miner].name,
+					p.delay, miners[p.miner].name, miners[mi].name, d)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse "partition start end groupA groupB" (the keyword has been removed);
+// a group is a comma-separated list of miners, and groupB may be "*" to
+// mean all miners not in groupA.
+func parsePartition(v []string, minerIndex map[string]int) (partition, error) {
+	var pt partition
+	if len(v) != 4 {
+		return pt, fmt.Errorf("partition requires start end groupA groupB: %v", v)
+	}
+	var err error
+	if pt.start, err = strconv.ParseFloat(v[0], 64); err != nil {
+		return pt, fmt.Errorf("bad partition start: %s %v", v[0], err)
+	}
+	if pt.end, err = strconv.ParseFloat(v[1], 64); err != nil {
+		return pt, fmt.Errorf("bad partition end: %s %v", v[1], err)
+	}
+	if pt.start < 0 || pt.end <= pt.start {
+		return pt, fmt.Errorf("bad partition times: %s %s", v[0], v[1])
+	}
+	pt.side = make([]int8, len(minerIndex))
+	for side, group := range v[2:] {
+		if side == 1 && group == "*" {
+			for mi := range pt.side {
+				if pt.side[mi] == 0 {
+					pt.side[mi] = 2
+				}
+			}
+			break
+		}
+		for _, name := range strings.Split(group, ",") {
+			mi, ok := minerIndex[name]
+			if !ok {
+				return pt, fmt.Errorf("no such miner: %s", name)
+			}
+			if pt.side[mi] != 0 {
+				return pt, fmt.Errorf("miner on both sides of partition: %s", name)
+			}
+			pt.side[mi] = int8(side + 1)
+		}
+	}
+	return pt, nil
+}
+
+// Verify that every miner can receive blocks from every other miner,
+// that is, that the peer graph is strongly connected. If not, the error
+// lists the strongly-connected components and which ones each can't
+// receive blocks from. This uses Kosaraju's algorithm.
+func checkConnectivity(miners []miner) error {
+	n := len(miners)
+	// A block goes to each of a miner's peers, and (immediately) to the
+	// other members of its pool, see relayPool().
+	pools := make(map[string][]int)
+	for mi, m := range miners {
+		if m.poolname != "" {
+			pools[m.poolname] = append(pools[m.poolname], mi)
+		}
+	}
+	outbound := make([][]int, n)
+	inbound := make([][]int, n) // reverse of the outbound edges
+	for mi, m := range miners {
+		for _, p := range m.peers {
+			outbound[mi] = append(outbound[mi], p.miner)
+		}
+		for _, pm := range pools[m.poolname] {
+			if pm != mi {
+				outbound[mi] = append(outbound[mi], pm)
+			}
+		}
+		for _, to := range outbound[mi] {
+			inbound[to] = append(inbound[to], mi)
+		}
+	}
+	// First pass, order miners by DFS finishing time.
+	visited := make([]bool, n)
+	order := make([]int, 0, n)
+	var visit func(mi int)
+	visit = func(mi int) {
+		visited[mi] = true
+		for _, to := range outbound[mi] {
+			if !visited[to] {
+				visit(to)
+			}
+		}
+		order = append(order, mi)
+	}
+	for mi := range miners {
+		if !visited[mi] {
+			visit(mi)
+		}
+	}
+	// Second pass, on the reverse graph, in reverse finishing order;
+	// each DFS tree is a component.
+	component := make([]int, n)
+	for mi := range component {
+		component[mi] = -1
+	}
+	var ncomp int
+	var assign func(mi int)
+	assign = func(mi int) {
+		component[mi] = ncomp
+		for _, from := range inbound[mi] {
+			if component[from] < 0 {
+				assign(from)
+			}
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if component[order[i]] < 0 {
+			assign(order[i])
+			ncomp++
+		}
+	}
+	if ncomp == 1 {
+		return nil
+	}
+
+	// reaches[c][d] means blocks can propagate from component c to d.
+	reaches := make([][]bool, ncomp)
+	for c := range reaches {
+		reaches[c] = make([]bool, ncomp)
+	}
+	for mi := range miners {
+		for _, to := range outbound[mi] {
+			reaches[component[mi]][component[to]] = true
+		}
+	}
+	for k := 0; k < ncomp; k++ { // transitive closure
+		for c := 0; c < ncomp; c++ {
+			for d := 0; d < ncomp; d++ {
+				if reaches[c][k] && reaches[k][d] {
+					reaches[c][d] = true
+				}
+			}
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "network is not strongly connected (%d components), "+
+		"use -allow-disconnected to run anyway", ncomp)
+	for c := 0; c < ncomp; c++ {
+		fmt.Fprintf(&sb, "\ncomponent %d:", c+1)
+		for mi, m := range miners {
+			if component[mi] == c {
+				fmt.Fprintf(&sb, " %s", m.name)
+			}
+		}
+		sep := "\n  can't receive blocks from component"
+		for d := 0; d < ncomp; d++ {
+			if d != c && !reaches[d][c] {
+				fmt.Fprintf(&sb, "%s %d", sep, d+1)
+				sep = ","
+			}
+		}
+	}
+	return errors.New(sb.String())
+}
+
+// Write the network topology as a Graphviz DOT directed graph; each edge
+// is labeled with its relay delay, which is also its preferred length
+// (used by the neato and fdp layouts).
+func writeDot(w io.Writer, miners []miner) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph network {")
+	for _, m := range miners {
+		fmt.Fprintf(bw, "  %q [label=\"%s\\n%s\"];\n", m.name,
+			strings.ReplaceAll(m.name, `"`, `\"`), formatHashrate(m.hashrate))
+	}
+	for _, m := range miners {
+		for _, p := range m.peers {
+			fmt.Fprintf(bw, "  %q -> %q [label=\"%g\" len=%g];\n",
+				m.name, miners[p.miner].name, p.delay, p.delay)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// Run one simulation to completion.
+func simulate(cfg Config) (Stats, error) {
+	if len(cfg.miners) == 0 {
+		return Stats{}, errors.New("no miners")
+	}
+	if cfg.blockinterval <= 0 {
+		return Stats{}, errors.New("block interval must be greater than zero")
+	}
+	if cfg.validation < 0 {
+		return Stats{}, errors.New("validation time must not be negative")
+	}
+	if cfg.duration < 0 {
+		return Stats{}, errors.New("duration must not be negative")
+	}
+	if cfg.duration > 0 && cfg.stopheight > 0 {
+		return Stats{}, errors.New("stopheight and duration are mutually exclusive")
+	}
+	if cfg.duration == 0 && cfg.stopheight <= 0 {
+		return Stats{}, errors.New("stopheight must be greater than zero")
+	}
+	if cfg.warmup < 0 {
+		return Stats{}, errors.New("warmup must not be negative")
+	}
+	if cfg.bandwidth < 0 {
+		return Stats{}, errors.New("bandwidth must not be negative")
+	}
+	if cfg.loss < 0 || cfg.loss > 1 {
+		return Stats{}, errors.New("loss must be between 0 and 1")
+	}
+	if cfg.jitter < 0 || cfg.jitter > 1 {
+		return Stats{}, errors.New("jitter must be between 0 and 1")
+	}
+	if cfg.fanout < 0 {
+		return Stats{}, errors.New("fanout must not be negative")
+	}
+	if cfg.compact && (cfg.headerdelay < 0 || cfg.headerdelay > 1) {
+		return Stats{}, errors.New("header delay must be between 0 and 1")
+	}
+	if cfg.retarget < 0 {
+		return Stats{}, errors.New("retarget interval must not be negative")
+	}
+	dist, err := parseDist(cfg.dist)
+	if err != nil {
+		return Stats{}, err
+	}
+	if dist == lognormal && cfg.sigma <= 0 {
+		return Stats{}, errors.New("sigma must be greater than zero")
+	}
+	tb, err := parseTiebreak(cfg.tiebreak)
+	if err != nil {
+		return Stats{}, err
+	}
+	feedist, feemean, err := parseFees(cfg.fees)
+	if err != nil {
+		return Stats{}, err
+	}
+	if cfg.subsidy < 0 {
+		return Stats{}, errors.New("subsidy must not be negative")
+	}
+	if cfg.k < 0 {
+		return Stats{}, errors.New("confirmations (k) must not be negative")
+	}
+	if cfg.doublespend < 0 {
+		return Stats{}, errors.New("doublespend confirmations must not be negative")
+	}
+	start := time.Now()
+	s := newState(cfg, dist, tb)
+	s.feedist, s.feemean = feedist, feemean
+	if s.totalhash == 0 {
+		return Stats{}, errors.New("no miners active at time zero")
+	}
+	if cfg.cleanup <= 0 {
+		return Stats{}, errors.New("cleanup interval must be greater than zero")
+	}
+	if cfg.checkpoint != "" && cfg.checkevery <= 0 {
+		return Stats{}, errors.New("checkpoint interval must be greater than zero")
+	}
+	if s.attacker >= 0 && cfg.doublespend == 0 {
+		return Stats{}, errors.New("attacker miner requires doublespend confirmations")
+	}
+	if s.attacker < 0 && cfg.doublespend > 0 {
+		return Stats{}, errors.New("doublespend requires an attacker miner")
+	}
+	if cfg.doublespend > 0 {
+		if cfg.attempts <= 0 {
+			return Stats{}, errors.New("race attempts must be greater than zero")
+		}
+		if cfg.racedeadline < 0 {
+			return Stats{}, errors.New("race deadline must not be negative")
+		}
+		if cfg.racedeadline == 0 {
+			s.racedeadline = float64(10 * cfg.doublespend * cfg.blockinterval)
+		}
+	}
+	ckcfg := checkpointConfig{cfg.seed, networkDigest(cfg.miners), tb,
+		cfg.ghost, cfg.propagation, cfg.queue, cfg.k, cfg.doublespend}
+	if cfg.resume != nil {
+		if err := s.restore(cfg.resume, ckcfg); err != nil {
+			return Stats{}, err
+		}
+	} else {
+		s.start()
+	}
+	// Pruning just once each time the height reaches the next multiple
+	// of the interval keeps its cost proportional to the number of blocks.
+	nextcleanup := (s.maxHeight/height(cfg.cleanup) + 1) * height(cfg.cleanup)
+	var nextcheckpoint height
+	if cfg.checkpoint != "" {
+		nextcheckpoint = (s.maxHeight/height(cfg.checkevery) + 1) *
+			height(cfg.checkevery)
+	}
+
+	// Main event loop
+	nextprogress := time.Now().Add(cfg.progressevery)
+	for !s.done() {
+		if s.check {
+			s.checkState()
+		}
+		if cfg.checkpoint != "" && s.maxHeight >= nextcheckpoint {
+			if err := s.save(cfg.checkpoint, ckcfg); err != nil {
+				return Stats{}, err
+			}
+			nextcheckpoint += height(cfg.checkevery)
+		}
+		s.events++
+		// Checking the time is expensive enough to not do it every event.
+		if s.progress != nil && s.events%1000 == 0 &&
+			time.Now().After(nextprogress) {
+			fmt.Fprintf(s.progress, "progress height %d time %.3f events %d\n",
+				s.maxHeight, s.currenttime, s.events)
+			nextprogress = time.Now().Add(cfg.progressevery)
+		}
+		if s.maxHeight >= nextcleanup {
+			s.cleanBlocks()
+			nextcleanup += height(cfg.cleanup)
+		}
+		ev := heap.Pop(&s.eventlist).(event)
+		s.currenttime = ev.when
+		if ev.kind == partitionHeal {
+			s.heal(ev.to)
+			continue
+		}
+		if ev.kind == raceDeadline {
+			if int(ev.bid) == s.races && s.racing(ev.to) {
+				s.trace(ev.to, "%.3f %s race-deadline\n", s.currenttime,
+					s.miners[ev.to].name)
+				s.raceEnd()
+			}
+			continue
+		}
+		mi := ev.to
+		m := &s.miners[mi]
+		switch ev.kind {
+		case minerJoin:
+			s.join(mi)
+			continue
+		case minerLeave:
+			s.leave(mi)
+			continue
+		case hashrateChange:
+			s.setHashrate(mi, m.schedule[ev.bid].hashrate)
+			continue
+		}
+		if !m.active {
+			// We've left the network, ignore our mining and peers.
+			continue
+		}
+		height := s.getheight(m.tip)
+		header := ev.kind == headerReceived
+		received := ev.kind == blockReceived || header
+		if received && !header && s.compact && ev.bid == m.tip &&
+			!m.selfish {
+			// We switched to this block when its header arrived; now
+			// that we have the full block, we can relay it (unless we
+			// mined it, or another peer's copy arrived first; relaying
+			// each copy would send it back and forth forever when peers
+			// don't skip equal-height blocks, see relay()).
+			if m.relayed != ev.bid {
+				s.relayPool(mi, ev.bid, true, ev.from)
+			}
+			continue
+		}
+		if !received {
+			// We mined a block (unless this is a stale event).
+			if ev.bid != m.tip || ev.when != m.solveat {
+				// This is a stale mining event, ignore it (we should
+				// still have an active mining event outstanding).
+				continue
+			}
+			ev.bid = s.baseblockid + blockid(len(s.blocks))
+			ev.from = -1 // (relay it to all our peers)
+			height++
+			if s.maxHeight < height {
+				s.maxHeight = height
+			}
+			b := block{
+				parent: m.tip,
+				height: height,
+				miner:  mi,
+				time:   s.currenttime + m.skew,
+				size:   m.size,
+			}
+			if s.feemean > 0 {
+				b.fee = s.feemean
+				if s.feedist == exponential {
+					b.fee = s.choice("fee", mi,
+						b.fee*s.feer.ExpFloat64())
+				}
+			}
+			s.retargetBlock(&b, s.getblock(m.tip))
+			if s.propagation {
+				b.adopters = make([]bool, len(s.miners))
+				for pi := range s.miners {
+					if s.miners[pi].active {
+						b.waiting++
+					} else {
+						b.adopters[pi] = true
+					}
+				}
+			}
+			if s.ghost {
+				// (It's counted when we start mining on it.)
+				b.weights = make([]int, len(s.miners))
+			}
+			if s.tiebreak != firstSeen {
+				b.seen = make([]bool, len(s.miners))
+			}
+			s.blocks = append(s.blocks, b)
+			if s.tree != nil {
+				s.treeBlock(ev.bid, &b)
+			}
+			s.trace(mi, "%.3f %s mined-newid %d on %d height %d\n",
+				s.currenttime, m.name, ev.bid, m.tip, height)
+			if m.selfish && !s.selfishMined(mi, ev.bid) {
+				s.startMining(mi, ev.bid)
+				continue
+			}
+			if s.racing(mi) {
+				// Withhold it (it's on our private chain).
+				s.startMining(mi, ev.bid)
+				s.raceCheck()
+				continue
+			}
+		} else {
+			// Block received from a peer (but could be a stale message).
+			if !s.validblock(ev.bid) {
+				continue
+			}
+			if s.ghost {
+				s.see(mi, ev.bid)
+			}
+			if header && m.selfish {
+				// Only react to full blocks.
+				continue
+			}
+			if s.racing(mi) {
+				if !header {
+					s.raceReceived(mi, ev.bid, ev.from)
+				}
+				continue
+			}
+			if m.selfish {
+				if !s.selfishReceived(mi, ev.bid) {
+					continue
+				}
+			} else if !s.better(mi, ev.bid) {
+				// We're already mining on a block that's at least as good.
+				continue
+			}
+			if s.forksBelowBase(m.tip, ev.bid) {
+				// Its branch was pruned while it was being relayed
+				// (possible with a small -cleanup), so it's stale.
+				continue
+			}
+			// This block is better, switch to it, first compute reorg depth.
+			s.trace(mi, "%.3f %s received-switch-to %d\n",
+				s.currenttime, m.name, ev.bid)
+			c := s.getblock(m.tip)  // current block we're mining on
+			t := s.getblock(ev.bid) // to block (switching to)
+			// Move back on the "to" (better) chain until even with current.
+			for t.height > c.height {
+				t = s.getblock(t.parent)
+			}
+			// With GHOST, the better chain can be shorter.
+			reorg := 0
+			for c.height > t.height {
+				reorg++
+				if !m.selfish && c.reversed < reorg {
+					c.reversed = reorg
+				}
+				// (No block on the winning branch has this height.)
+				s.displace(c, t)
+				c = s.getblock(c.parent)
+			}
+			// From the same height, count blocks until these branches
+			// meet, or reach their (different) genesis blocks.
+			for t != c && t.height > 0 {
+				reorg++
+				// The block we're abandoning had reorg confirmations
+				// (a selfish miner's private chain doesn't count).
+				if !m.selfish && c.reversed < reorg {
+					c.reversed = reorg
+				}
+				s.displace(c, t)
+				t = s.getblock(t.parent)
+				c = s.getblock(c.parent)
+			}
+			if reorg > 0 {
+				s.trace(mi, "%.3f %s reorg %d maxreorg %d\n",
+					s.currenttime, m.name, reorg, s.maxreorg)
+			}
+			if s.maxreorg < reorg {
+				s.maxreorg = reorg
+			}
+			if reorg > 0 {
+				// Count each miner's reorg separately (rather than once
+				// per better block) since each one wastes work.
+				for len(s.reorgs) <= reorg {
+					s.reorgs = append(s.reorgs, 0)
+				}
+				s.reorgs[reorg]++
+			}
+		}
+		if m.pool >= 0 {
+			// The other members of our pool learn of this block
+			// immediately; they forward it to their own peers.
+			for _, pm := range s.pools[m.pool].members {
+				if pm != mi && s.miners[pm].active {
+					s.startMining(pm, ev.bid)
+				}
+			}
+		}
+		if !header {
+			// (With only a header, we can't relay the block yet.)
+			s.relayPool(mi, ev.bid, received, ev.from)
+		}
+		s.startMining(mi, ev.bid)
+		if s.racing(s.attacker) {
+			s.raceHonest(ev.bid, !received)
+		}
+	}
+	if s.tape != nil {
+		if s.tape.err != nil {
+			return Stats{}, s.tape.err
+		}
+		if s.tape.w != nil {
+			if err := s.tape.w.Flush(); err != nil {
+				return Stats{}, err
+			}
+		}
+	}
+	s.cleanBlocks()
+	if s.check {
+		s.checkState()
+	}
+	if s.csvlog != nil || s.tree != nil {
+		s.logUnsettled()
+	}
+	if s.csvlog != nil {
+		s.csvlog.Flush()
+		if err := s.csvlog.Error(); err != nil {
+			return Stats{}, err
+		}
+	}
+	if s.tree != nil {
+		fmt.Fprintln(s.tree, "}")
+		if err := s.tree.Flush(); err != nil {
+			return Stats{}, err
+		}
+	}
+	st := s.stats()
+	st.elapsed = time.Since(start)
+	return st, nil
+}
+
+// Schedule the initial events (the new state is at time zero).
+func (s *state) start() {
+	for pi, pt := range s.partitions {
+		heap.Push(&s.eventlist, event{
+			to: pi, kind: partitionHeal, when: pt.end})
+	}
+
+	// Start all miners off mining their first blocks.
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		if m.leaveat > 0 {
+			heap.Push(&s.eventlist, event{
+				to: mi, kind: minerLeave, when: m.leaveat})
+		}
+		for i, hc := range m.schedule {
+			heap.Push(&s.eventlist, event{
+				to: mi, kind: hashrateChange, when: hc.when, bid: blockid(i)})
+		}
+		if !m.active {
+			heap.Push(&s.eventlist, event{
+				to: mi, kind: minerJoin, when: m.joinat})
+			continue
+		}
+		// Begin mining on our genesis block (height zero).
+		s.activate(mi, s.baseblockid+blockid(m.genesis))
+		s.startMining(mi, m.tip)
+	}
+	if s.attacker >= 0 {
+		s.raceStart()
+	}
+}
+
+// Return the newest block that all active miners' tips descend from (zero
+// if none) by moving back from every tip; this is slow, so it's only used
+// by checkState() to verify the incrementally-maintained s.final.
+func (s *state) commonAncestor() blockid {
+	blockAtSameHeight := make([]blockid, 0, len(s.miners))
+	for _, m := range s.miners {
+		if m.active {
+			blockAtSameHeight = append(blockAtSameHeight, m.tip)
+		}
+	}
+	if len(blockAtSameHeight) == 0 {
+		return 0
+	}
+	// Find the minimum height that any miner is at.
+	var minheight height
+	for i, tip := range blockAtSameHeight {
+		h := s.getheight(tip)
+		if i == 0 || minheight > h {
+			minheight = h
+		}
+	}
+
+	// Move down from all tips until they're at the same (minimum) height.
+	for i := range blockAtSameHeight {
+		for s.getheight(blockAtSameHeight[i]) > minheight {
+			blockAtSameHeight[i] = s.getblock(blockAtSameHeight[i]).parent
+		}
+	}
+	// Find the block that all tips are based on (oldest branch point).
+	for {
+		// Determine if all the blockAtSameHeight[] are equal.
+		var i int
+		for i = 1; i < len(blockAtSameHeight); i++ {
+			if blockAtSameHeight[i] != blockAtSameHeight[0] {
+				break
+			}
+		}
+		if i >= len(blockAtSameHeight) {
+			// Yes, they are all equal.
+			break
+		}
+		if s.getheight(blockAtSameHeight[0]) == 0 {
+			// The tips descend from different genesis blocks.
+			return 0
+		}
+		// Everyone move down one and try again.
+		for i = 0; i < len(blockAtSameHeight); i++ {
+			blockAtSameHeight[i] = s.getblock(blockAtSameHeight[i]).parent
+		}
+	}
+	return blockAtSameHeight[0]
+}
+
+// Verify the simulator's invariants (for -check), and panic if one
+// doesn't hold; this is slow, but catches bugs close to where they happen.
+func (s *state) checkState() {
+	fail := func(format string, a ...interface{}) {
+		panic(fmt.Sprintf("check failed at time %.3f after %d events: %s",
+			s.currenttime, s.events, fmt.Sprintf(format, a...)))
+	}
+	// A block's parent and height never change, so each block needs to
+	// be checked only once. The parent of a remaining stale block may
+	// have been pruned, but it must have existed (be older).
+	if s.checked < s.baseblockid+1 {
+		s.checked = s.baseblockid + 1
+	}
+	for ; s.validblock(s.checked); s.checked++ {
+		b := s.getblock(s.checked)
+		if b.parent >= s.checked {
+			fail("block %d parent %d isn't older", s.checked, b.parent)
+		}
+		if s.validblock(b.parent) && s.getheight(b.parent) != b.height-1 {
+			fail("block %d height %d parent %d height %d", s.checked,
+				b.height, b.parent, s.getheight(b.parent))
+		}
+		if b.height > s.maxHeight {
+			fail("block %d height %d above max height %d", s.checked,
+				b.height, s.maxHeight)
+		}
+	}
+	var totalhash float64
+	var nactive int
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		if !m.active {
+			// Its tip may have been pruned (it will sync when it joins).
+			continue
+		}
+		totalhash += m.hashrate
+		nactive++
+		if !s.validblock(m.tip) {
+			fail("miner %s tip %d isn't a valid block", m.name, m.tip)
+		}
+		if s.getheight(m.tip) > s.maxHeight {
+			fail("miner %s tip %d height %d above max height %d", m.name,
+				m.tip, s.getheight(m.tip), s.maxHeight)
+		}
+	}
+	// (Allow for rounding error with fractional hashrates.)
+	if math.Abs(totalhash-s.totalhash) > 1e-9*totalhash {
+		fail("total hashrate %g, active miners' sum %g", s.totalhash,
+			totalhash)
+	}
+	if nactive != s.nactive {
+		fail("%d active miners, counted %d", nactive, s.nactive)
+	}
+	if final := s.commonAncestor(); final != s.final {
+		fail("finalized block %d, tips' common ancestor %d", s.final, final)
+	}
+	if !s.ghost {
+		return
+	}
+	// Above ghostfloor, each of a block's weights is its children's sum,
+	// plus one if the miner has seen it (children come after parents).
+	above := func(b *block) bool {
+		return s.ghostfloor == 0 || b.height > s.ghostfloor
+	}
+	sum := make([]int, len(s.blocks))
+	for mi := range s.miners {
+		for i := range sum {
+			sum[i] = 0
+		}
+		for i := len(s.blocks) - 1; i >= 0; i-- {
+			b := &s.blocks[i]
+			if !above(b) {
+				continue
+			}
+			if b.weights[mi] > 0 {
+				sum[i]++
+			}
+			if b.weights[mi] != sum[i] {
+				fail("block %d miner %s weight %d, subtree has %d",
+					s.baseblockid+blockid(i), s.miners[mi].name,
+					b.weights[mi], sum[i])
+			}
+			if s.validblock(b.parent) && above(s.getblock(b.parent)) {
+				sum[b.parent-s.baseblockid] += sum[i]
+			}
+		}
+	}
+}
+
+// Return true if the simulation has reached its stopping height or time.
+func (s *state) done() bool {
+	if len(s.eventlist) == 0 {
+		return true
+	}
+	if s.attacker >= 0 && s.races >= s.attempts {
+		return true
+	}
+	if s.tape != nil && s.tape.err != nil {
+		return true
+	}
+	if s.duration > 0 {
+		return s.eventlist[0].when > s.duration
+	}
+	return s.maxHeight >= height(s.stopheight)
+}
+
+// Return the (simulation) time a block was actually mined, without the
+// miner's clock skew.
+func (s *state) trueTime(b *block) float64 {
+	if b.miner < 0 {
+		return b.time // genesis
+	}
+	return b.time - s.miners[b.miner].skew
+}
+
+// The saved state of a simulation run (see -checkpoint); the rest of the
+// state comes from the configuration, which must be the same when resuming.
+type checkpoint struct {
+	Config      checkpointConfig // to check that the configuration matches
+	CurrentTime float64
+	Blocks      []checkpointBlock
+	Miners      []checkpointMiner
+	Events      []checkpointEvent // in heap order
+	Draws       uint64            // from s.r
+	FeeDraws    uint64
+	MaxHeight   height
+	BaseBlockID blockid
+	MaxReorg    int
+	TotalHash   float64
+	Mined       height
+	WarmupTime  float64
+	Processed   int64 // events
+	Retargets   int
+	Dropped     int
+	Queued      int
+	QueueWait   float64
+	Reorgs      []int
+	Displaced   [][]int
+	PropTimes   []float64
+	Confirmed   []int
+	Reversals   []int
+	Intervals   []int
+	Uncles      height
+	Races       int
+	RacesWon    []int
+	RacePay     height
+	RaceHonest  height
+	RaceWon     int
+	Active      int
+	Final       blockid
+	GhostFloor  height
+}
+
+// The options that a resumed run must share with the run that saved the
+// checkpoint: the seed, and the ones that shape the saved state.
+type checkpointConfig struct {
+	Seed        int64
+	Network     uint64 // see networkDigest()
+	Tiebreak    tiebreak
+	Ghost       bool
+	Propagation bool
+	Queue       bool
+	K           int
+	DoubleSpend int
+}
+
+// Return a digest of the network's miners: their names, peers, and other
+// configured properties (a different network may have as many miners).
+func networkDigest(miners []miner) uint64 {
+	h := fnv.New64a()
+	for _, m := range miners {
+		fmt.Fprintf(h, "%s %g %d %g %q %g %g %g %v %v %v %q|",
+			m.name, m.hashrate, m.size, m.validation, m.poolname,
+			m.joinat, m.leaveat, m.skew, m.schedule, m.selfish,
+			m.attacker, m.genesisname)
+		for _, p := range m.peers {
+			fmt.Fprintf(h, "%d %g|", p.miner, p.delay)
+		}
+	}
+	return h.Sum64()
+}
+
+type checkpointBlock struct {
+	Parent      blockid
+	Height      height
+	Miner       int
+	Time        float64
+	Best        bool
+	Size        int
+	Fee         float64
+	Difficulty  float64
+	PeriodStart float64
+	Confirms    int
+	Reversed    int
+	Weights     []int
+	Above       int
+	Tips        int
+	Adopters    []bool
+	Waiting     int
+	Propagated  float64
+	Seen        []bool
+}
+
+type checkpointMiner struct {
+	Hashrate  float64
+	Mined     height
+	Credit    height
+	Uncles    height
+	Revenue   float64
+	Tip       blockid
+	Active    bool
+	SolveAt   float64
+	HashWork  float64
+	HashSince float64
+	PubHeight height
+	Race      bool
+	Relayed   blockid
+	Draws     uint64
+	LinkFree  []float64
+}
+
+type checkpointEvent struct {
+	To   int
+	Kind eventkind
+	When float64
+	Bid  blockid
+	From int
+}
+
+// Write the simulation state to pathname; write a temporary file first and
+// rename it so that a crash can't leave a partial checkpoint.
+func (s *state) save(pathname string, ckcfg checkpointConfig) error {
+	ck := checkpoint{
+		Config:      ckcfg,
+		CurrentTime: s.currenttime,
+		Draws:       s.src.draws,
+		FeeDraws:    s.feesrc.draws,
+		MaxHeight:   s.maxHeight,
+		BaseBlockID: s.baseblockid,
+		MaxReorg:    s.maxreorg,
+		TotalHash:   s.totalhash,
+		Mined:       s.mined,
+		WarmupTime:  s.warmuptime,
+		Processed:   s.events,
+		Retargets:   s.retargets,
+		Dropped:     s.dropped,
+		Queued:      s.queued,
+		QueueWait:   s.queuewait,
+		Reorgs:      s.reorgs,
+		Displaced:   s.displaced,
+		PropTimes:   s.proptimes,
+		Confirmed:   s.confirmed,
+		Reversals:   s.reversals,
+		Intervals:   s.intervals,
+		Uncles:      s.uncles,
+		Races:       s.races,
+		RacesWon:    s.raceswon,
+		RacePay:     s.racepay,
+		RaceHonest:  s.racehonest,
+		RaceWon:     s.racewon,
+		Active:      s.nactive,
+		Final:       s.final,
+		GhostFloor:  s.ghostfloor,
+	}
+	for _, b := range s.blocks {
+		ck.Blocks = append(ck.Blocks, checkpointBlock{
+			b.parent, b.height, b.miner, b.time, b.best, b.size, b.fee,
+			b.difficulty, b.periodstart, b.confirms, b.reversed, b.weights,
+			b.above, b.tips, b.adopters, b.waiting, b.propagated, b.seen})
+	}
+	for _, m := range s.miners {
+		ck.Miners = append(ck.Miners, checkpointMiner{
+			m.hashrate, m.mined, m.credit, m.uncles, m.revenue, m.tip, m.active,
+			m.solveat, m.hashwork, m.hashsince, m.pubheight, m.race,
+			m.relayed, m.src.draws, m.linkfree})
+	}
+	for _, e := range s.eventlist {
+		ck.Events = append(ck.Events,
+			checkpointEvent{e.to, e.kind, e.when, e.bid, e.from})
+	}
+	tmp := pathname + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(&ck); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.trace(-1, "%.3f checkpoint height %d\n", s.currenttime, s.maxHeight)
+	return os.Rename(tmp, pathname)
+}
+
+// Read a checkpoint written by save().
+func readCheckpoint(pathname string) (*checkpoint, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ck := new(checkpoint)
+	if err := gob.NewDecoder(f).Decode(ck); err != nil {
+		return nil, fmt.Errorf("bad checkpoint: %s %v", pathname, err)
+	}
+	return ck, nil
+}
+
+// Replace the (new) state with the saved one.
+func (s *state) restore(ck *checkpoint, ckcfg checkpointConfig) error {
+	if ck.Config != ckcfg || len(ck.Miners) != len(s.miners) {
+		return errors.New("checkpoint doesn't match the configuration")
+	}
+	s.currenttime = ck.CurrentTime
+	s.src.replay(ck.Draws)
+	s.feesrc.replay(ck.FeeDraws)
+	s.maxHeight = ck.MaxHeight
+	s.baseblockid = ck.BaseBlockID
+	s.maxreorg = ck.MaxReorg
+	s.totalhash = ck.TotalHash
+	s.mined = ck.Mined
+	s.warmuptime = ck.WarmupTime
+	s.events = ck.Processed
+	s.retargets = ck.Retargets
+	s.dropped = ck.Dropped
+	s.queued = ck.Queued
+	s.queuewait = ck.QueueWait
+	s.reorgs = ck.Reorgs
+	s.proptimes = ck.PropTimes
+	for l := range s.displaced {
+		if l < len(ck.Displaced) {
+			copy(s.displaced[l], ck.Displaced[l])
+		}
+	}
+	s.uncles = ck.Uncles
+	s.intervals = ck.Intervals
+	s.races = ck.Races
+	copy(s.raceswon, ck.RacesWon)
+	s.racepay = ck.RacePay
+	s.racehonest = ck.RaceHonest
+	s.racewon = ck.RaceWon
+	s.nactive = ck.Active
+	s.final = ck.Final
+	s.ghostfloor = ck.GhostFloor
+	copy(s.confirmed, ck.Confirmed)
+	copy(s.reversals, ck.Reversals)
+	s.blocks = s.blocks[:0]
+	for _, b := range ck.Blocks {
+		s.blocks = append(s.blocks, block{
+			b.Parent, b.Height, b.Miner, b.Time, b.Best, b.Size, b.Fee,
+			b.Difficulty, b.PeriodStart, b.Confirms, b.Reversed, b.Weights,
+			b.Above, b.Tips, b.Adopters, b.Waiting, b.Propagated, b.Seen})
+	}
+	for mi, cm := range ck.Miners {
+		m := &s.miners[mi]
+		m.hashrate = cm.Hashrate
+		m.mined = cm.Mined
+		m.credit = cm.Credit
+		m.uncles = cm.Uncles
+		m.revenue = cm.Revenue
+		m.tip = cm.Tip
+		m.active = cm.Active
+		m.solveat = cm.SolveAt
+		m.hashwork = cm.HashWork
+		m.hashsince = cm.HashSince
+		m.pubheight = cm.PubHeight
+		m.race = cm.Race
+		m.relayed = cm.Relayed
+		copy(m.linkfree, cm.LinkFree)
+		m.src.replay(cm.Draws)
+	}
+	s.eventlist = s.eventlist[:0]
+	for _, e := range ck.Events {
+		s.eventlist = append(s.eventlist, event{e.To, e.Kind, e.When, e.Bid, e.From})
+	}
+	s.trace(-1, "%.3f resume height %d\n", s.currenttime, s.maxHeight)
+	return nil
+}
+
+// Return the number of blocks that reached each number of confirmations:
+// the stale blocks counted by cleanBlocks(), plus the best-chain blocks,
+// each of which has as many confirmations as the highest (honest) tip
+// gives it. Counting the best-chain blocks only at the end of the run
+// makes the result independent of when cleanBlocks() runs.
+func (s *state) bestConfirmed() []int {
+	confirmed := append([]int(nil), s.confirmed...)
+	top := s.blocks[0].height
+	for _, m := range s.miners {
+		if m.active && !m.selfish && !m.attacker &&
+			s.getheight(m.tip) > top {
+			top = s.getheight(m.tip)
+		}
+	}
+	for d := 1; d < len(confirmed); d++ {
+		// Best-chain heights warmup to blocks[0].height.
+		n := top - height(d) + 1
+		if n > s.blocks[0].height {
+			n = s.blocks[0].height
+		}
+		n -= s.warmup - 1
+		if n > 0 {
+			confirmed[d] += int(n)
+		}
+	}
+	return confirmed
+}
+
+// Summarize the results of a completed run.
+func (s *state) stats() Stats {
+	st := Stats{
+		mined:     s.mined,
+		bestchain: s.blocks[0].height - s.warmup + 1,
+		simtime:   s.trueTime(&s.blocks[0]),
+		starttime: s.warmuptime,
+		maxreorg:  s.maxreorg,
+		retargets: s.retargets,
+		dropped:   s.dropped,
+		queued:    s.queued,
+		queuewait: s.queuewait,
+		reorgs:    s.reorgs,
+		displaced: s.displaced,
+		proptimes: s.proptimes,
+		confirmed: s.bestConfirmed(),
+		reversals: s.reversals,
+		intervals: s.intervals,
+		uncles:    s.uncles,
+		uncled:    s.uncledepth > 0,
+		fees:      s.feemean > 0,
+		events:    s.events,
+		races:     s.races,
+		raceswon:  s.raceswon,
+	}
+	if st.bestchain < 0 {
+		st.bestchain = 0
+	}
+	st.difficulty = s.blocks[0].difficulty / s.basehash
+	sort.Float64s(st.proptimes)
+	st.stale = st.mined - st.bestchain
+	st.stalerate = fraction(float64(st.stale), float64(st.mined))
+	st.aveblock = fraction(st.simtime-st.starttime, float64(st.bestchain))
+	for mi := range s.miners {
+		m := &s.miners[mi]
+		s.accrue(m)
+		// Report the configured hashrate (m.hashrate may have changed).
+		hashrate := s.initialhash[mi]
+		st.totalhash += hashrate
+		st.minerstats = append(st.minerstats, minerStats{
+			name:     m.name,
+			hashrate: hashrate,
+			mined:    m.mined,
+			credit:   m.credit,
+			avehash:  fraction(m.hashwork, s.currenttime),
+			delay:    averageDelay(m.peers),
+			uncles:   m.uncles,
+			revenue:  m.revenue,
+		})
+		st.revenue += m.revenue
+		if len(m.schedule) > 0 {
+			st.scheduled = true
+		}
+	}
+	for _, p := range s.pools {
+		ps := minerStats{name: p.name}
+		for _, pm := range p.members {
+			ps.hashrate += st.minerstats[pm].hashrate
+			ps.avehash += st.minerstats[pm].avehash
+			ps.uncles += st.minerstats[pm].uncles
+			ps.revenue += st.minerstats[pm].revenue
+			ps.mined += s.miners[pm].mined
+			ps.credit += s.miners[pm].credit
+		}
+		st.poolstats = append(st.poolstats, ps)
+	}
+	return st
+}
+
+// Return the average latency of the given peer connections.
+func averageDelay(peers []peer) float64 {
+	var total float64
+	for _, p := range peers {
+		total += p.delay
+	}
+	return fraction(total, float64(len(peers)))
+}
+
+func main() {
+	flag.Parse()
+	parse, pathname := parseNetwork, args.network
+	if args.matrix != "" {
+		parse, pathname = parseMatrix, args.matrix
+	}
+	networkfile, dir := os.Stdin, "."
+	if pathname != "-" {
+		dir = filepath.Dir(pathname)
+		var err error
+		networkfile, err = os.Open(pathname)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open failed:", err)
+			os.Exit(1)
+		}
+	}
+	net, err := parse(networkfile, dir)
+	networkfile.Close()
+	if err == nil && args.symmetric {
+		err = symmetrize(net.miners)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if args.dot != "" {
+		dotfile, err := os.Create(args.dot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "create failed:", err)
+			os.Exit(1)
+		}
+		err = writeDot(dotfile, net.miners)
+		if cerr := dotfile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if args.dotonly {
+			return
+		}
+	}
+	if !args.disconnected {
+		if err := checkConnectivity(net.miners); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if args.seed == -1 {
+		args.seed = time.Now().UnixNano()
+	}
+	if args.duration != 0 {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "h" {
+				fmt.Fprintln(os.Stderr, "-h and -duration are mutually exclusive")
+				os.Exit(1)
+			}
+		})
+		args.stopheight = 0
+	}
+	cfg := Config{
+		miners:        net.miners,
+		partitions:    net.partitions,
+		blockinterval: args.blockinterval,
+		stopheight:    args.stopheight,
+		warmup:        args.warmup,
+		duration:      args.duration,
+		seed:          args.seed,
+		retarget:      args.retarget,
+		dist:          args.dist,
+		sigma:         args.sigma,
+		bandwidth:     args.bandwidth,
+		jitter:        args.jitter,
+		loss:          args.loss,
+		tiebreak:      args.tiebreak,
+		ghost:         args.ghost,
+		compact:       args.compact,
+		headerdelay:   args.headerdelay,
+		queue:         args.queue,
+		fanout:        args.fanout,
+		fees:          args.fees,
+		subsidy:       args.subsidy,
+		cleanup:       args.cleanup,
+		check:         args.check,
+		validation:    args.validation,
+		isolation:     args.isolation,
+		k:             args.k,
+		buckets:       args.buckets,
+		uncledepth:    args.uncledepth,
+		reorgmatrix:   args.reorgmatrix,
+		propagation:   args.propagation,
+		doublespend:   args.doublespend,
+		attempts:      args.attempts,
+		racedeadline:  args.racedeadline,
+	}
+	if args.traceenable {
+		cfg.trace = allTrace
+	}
+	if args.traceminer != "" {
+		traced := -1
+		for mi, m := range net.miners {
+			if m.name == args.traceminer {
+				traced = mi
+			}
+		}
+		if traced < 0 {
+			fmt.Fprintln(os.Stderr, "no such miner:", args.traceminer)
+			os.Exit(1)
+		}
+		cfg.trace = minerTrace(traced)
+	}
+	if args.checkpoint != "" || args.resume != "" {
+		if args.runs > 1 || args.csv != "" || args.tree != "" {
+			fmt.Fprintln(os.Stderr, "-checkpoint and -resume can't be combined with -runs, -csv, or -tree")
+			os.Exit(1)
+		}
+		cfg.checkpoint = args.checkpoint
+		cfg.checkevery = args.checkevery
+	}
+	if args.resume != "" {
+		ck, err := readCheckpoint(args.resume)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cfg.resume = ck
+	}
+	if args.progress > 0 {
+		cfg.progress = os.Stderr
+		cfg.progressevery = time.Duration(args.progress * float64(time.Second))
+	}
+	if args.runs < 1 {
+		fmt.Fprintln(os.Stderr, "runs must be at least 1")
+		os.Exit(1)
+	}
+	if args.record != "" || args.replay != "" {
+		if args.record != "" && args.replay != "" {
+			fmt.Fprintln(os.Stderr, "-record and -replay can't be combined")
+			os.Exit(1)
+		}
+		if args.runs > 1 || args.checkpoint != "" || args.resume != "" {
+			fmt.Fprintln(os.Stderr, "-record and -replay can't be combined with -runs, -checkpoint, or -resume")
+			os.Exit(1)
+		}
+	}
+	if args.runs > 1 {
+		if args.json || args.csv != "" || args.tree != "" {
+			fmt.Fprintln(os.Stderr, "-runs can't be combined with -json, -csv, or -tree")
+			os.Exit(1)
+		}
+		if err := monteCarlo(cfg, args.runs, args.runsverbose); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if args.csv != "" {
+		csvfile, err := os.Create(args.csv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "create failed:", err)
+			os.Exit(1)
+		}
+		defer csvfile.Close()
+		cfg.csvlog = csvfile
+	}
+	if args.tree != "" {
+		treefile, err := os.Create(args.tree)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "create failed:", err)
+			os.Exit(1)
+		}
+		defer treefile.Close()
+		cfg.tree = treefile
+	}
+	if args.record != "" {
+		recordfile, err := os.Create(args.record)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "create failed:", err)
+			os.Exit(1)
+		}
+		defer recordfile.Close()
+		cfg.record = recordfile
+	}
+	if args.replay != "" {
+		replayfile, err := os.Open(args.replay)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open failed:", err)
+			os.Exit(1)
+		}
+		defer replayfile.Close()
+		cfg.replay = replayfile
+	}
+	st, err := simulate(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if args.json {
+		err = printJSON(os.Stdout, cfg, st)
+	} else {
+		printSummary(cfg, st)
+	}
+	if args.timing {
+		// To standard error, so the results are still reproducible.
+		fmt.Fprintf(os.Stderr, "%-20s %14.3f\n", "elapsed-seconds",
+			st.elapsed.Seconds())
+		fmt.Fprintf(os.Stderr, "%-20s %14d\n", "events", st.events)
+		fmt.Fprintf(os.Stderr, "%-20s %14.0f\n", "events-per-second",
+			float64(st.events)/st.elapsed.Seconds())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Accumulates samples to compute their mean and (sample) standard deviation.
+type sampleStats struct {
+	n          int
+	sum, sumsq float64
+}
+
+func (ss *sampleStats) add(x float64) {
+	ss.n++
+	ss.sum += x
+	ss.sumsq += x * x
+}
+func (ss *sampleStats) mean() float64 {
+	return ss.sum / float64(ss.n)
+}
+
+// Format x (the mean or standard deviation) using verb, or return "n/a"
+// if there are no samples.
+func (ss *sampleStats) format(verb string, x float64) string {
+	if ss.n == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf(verb, x)
+}
+func (ss *sampleStats) stddev() float64 {
+	if ss.n < 2 {
+		return 0
+	}
+	mean := ss.mean()
+	v := (ss.sumsq - float64(ss.n)*mean*mean) / float64(ss.n-1)
+	if v < 0 {
+		// rounding error
+		return 0
+	}
+	return math.Sqrt(v)
+}
+
+// Run the simulation the given number of times, each with a different seed
+// (cfg.seed, cfg.seed+1, ...), and print aggregate statistics.
+func monteCarlo(cfg Config, runs int, verbose bool) error {
+	var stalerate, aveblock, maxreorg sampleStats
+	var races int
+	var raceswon []int
+	baseseed := cfg.seed
+	for i := 0; i < runs; i++ {
+		cfg.seed = baseseed + int64(i)
+		st, err := simulate(cfg)
+		if err != nil {
+			return err
+		}
+		// A run too short to finish a best-chain block has no
+		// stale rate or block time; leave it out of those averages.
+		if st.mined > 0 {
+			stalerate.add(st.stalerate * 100)
+		}
+		if st.bestchain > 0 {
+			aveblock.add(st.aveblock)
+		}
+		maxreorg.add(float64(st.maxreorg))
+		races += st.races
+		if raceswon == nil {
+			raceswon = make([]int, len(st.raceswon))
+		}
+		for d := range st.raceswon {
+			raceswon[d] += st.raceswon[d]
+		}
+		if verbose {
+			fmt.Printf("run %-6d seed %-20d stale-rate %6.2f%% "+
+				"ave-block-time %10.3f max-reorg-depth %4d\n",
+				i, cfg.seed, st.stalerate*100, st.aveblock, st.maxreorg)
+		}
+	}
+	fmt.Printf("%-20s %14d\n", "seed-arg", baseseed)
+	fmt.Printf("%-20s %14d\n", "runs-arg", runs)
+	fmt.Printf("%-20s %14d\n", "block-interval-arg", cfg.blockinterval)
+	if cfg.duration > 0 {
+		fmt.Printf("%-20s %14.3f\n", "duration-arg", cfg.duration)
+	} else {
+		fmt.Printf("%-20s %14d\n", "stopheight-arg", cfg.stopheight)
+	}
+	if cfg.warmup > 0 {
+		fmt.Printf("%-20s %14d\n", "warmup-arg", cfg.warmup)
+	}
+	fmt.Printf("%-20s %15s\n", "stale-rate-mean",
+		stalerate.format("%.2f%%", stalerate.mean()))
+	fmt.Printf("%-20s %15s\n", "stale-rate-stddev",
+		stalerate.format("%.2f%%", stalerate.stddev()))
+	fmt.Printf("%-20s %14s\n", "ave-block-time-mean",
+		aveblock.format("%.3f", aveblock.mean()))
+	fmt.Printf("%-20s %14s\n", "ave-block-time-stddev",
+		aveblock.format("%.3f", aveblock.stddev()))
+	fmt.Printf("%-20s %14.3f\n", "max-reorg-mean", maxreorg.mean())
+	fmt.Printf("%-20s %14.3f\n", "max-reorg-stddev", maxreorg.stddev())
+	if cfg.doublespend > 0 {
+		printRaces(races, raceswon)
+	}
+	return nil
+}
+
+// Format n/d using verb, or return "n/a" if d is zero (for example, the
+// stale rate of a miner that hasn't mined any blocks).
+func ratio(verb string, n, d float64) string {
+	if d == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf(verb, n/d)
+}
+
+// Return the sum of the values.
+func sum(v []float64) float64 {
+	var total float64
+	for _, x := range v {
+		total += x
+	}
+	return total
+}
+
+// Return the index of the pct percentile (nearest rank) of n (> 0)
+// sorted values.
+func rank(n, pct int) int {
+	i := (n*pct + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// Format the pct percentile of the sorted values, or return "n/a" if
+// there aren't any.
+func percentile(sorted []float64, pct int) string {
+	if len(sorted) == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.3f", sorted[rank(len(sorted), pct)])
+}
+
+// Format a hashrate as an integer if it is one (so, without an exponent,
+// and otherwise with as many digits as needed).
+func formatHashrate(h float64) string {
+	return strconv.FormatFloat(h, 'f', -1, 64)
+}
+
+// Return n/d, or zero if d is zero (so JSON doesn't see NaN).
+func fraction(n, d float64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// JSON representation of the summary; fractions are in the range 0 to 1.
+type jsonSummary struct {
+	Seed          int64            `json:"seed"`
+	BlockInterval int              `json:"block-interval"`
+	StopHeight    int64            `json:"stopheight"`
+	Duration      float64          `json:"duration"`
+	Warmup        int64            `json:"warmup,omitempty"`
+	TotalHashrate float64          `json:"total-hashrate"`
+	MinedBlocks   height           `json:"mined-blocks"`
+	TotalSimtime  float64          `json:"total-simtime"`
+	AveBlockTime  float64          `json:"ave-block-time"`
+	StaleBlocks   height           `json:"stale-blocks"`
+	StaleRate     float64          `json:"stale-rate"`
+	MaxReorgDepth int              `json:"max-reorg-depth"`
+	Difficulty    float64          `json:"final-difficulty"`
+	Retargets     int              `json:"retargets"`
+	DroppedRelays int              `json:"dropped-relays"`
+	Uncles        height           `json:"uncles,omitempty"`
+	ReorgDepths   map[int]int      `json:"reorg-depth-histogram"`
+	Displaced     []jsonDisplaced  `json:"displaced,omitempty"`
+	Propagation   *jsonPropagation `json:"propagation,omitempty"`
+	Reversals     map[int]float64  `json:"reversal-probability,omitempty"`
+	Races         int              `json:"races,omitempty"`
+	DoubleSpends  map[int]float64  `json:"doublespend-probability,omitempty"`
+	Miners        []jsonMiner      `json:"miners"`
+	Pools         []jsonMiner      `json:"pools,omitempty"`
+}
+
+type jsonPropagation struct {
+	Blocks int     `json:"blocks"`
+	Mean   float64 `json:"mean"`
+	Pct90  float64 `json:"90pct"`
+	Pct99  float64 `json:"99pct"`
+	Max    float64 `json:"max"`
+}
+
+type jsonDisplaced struct {
+	Loser  string `json:"loser"`
+	Winner string `json:"winner"`
+	Blocks int    `json:"blocks"`
+}
+
+type jsonMiner struct {
+	Name             string  `json:"name"`
+	Hashrate         float64 `json:"hashrate"`
+	HashrateFraction float64 `json:"hashrate-fraction"`
+	BlockFraction    float64 `json:"block-fraction"`
+	StaleRate        float64 `json:"stale-rate"`
+	AveHashrate      float64 `json:"ave-hashrate"`
+	Uncles           height  `json:"uncles,omitempty"`
+	RevenueFraction  float64 `json:"revenue-fraction"`
+}
+
+func (st *Stats) jsonMiner(m minerStats) jsonMiner {
+	return jsonMiner{
+		Name:             m.name,
+		Hashrate:         m.hashrate,
+		HashrateFraction: fraction(m.hashrate, st.totalhash),
+		BlockFraction: fraction(float64(m.credit),
+			float64(st.bestchain)),
+		StaleRate: fraction(float64(m.mined-m.credit),
+			float64(m.mined)),
+		AveHashrate:     m.avehash,
+		Uncles:          m.uncles,
+		RevenueFraction: fraction(m.revenue, st.revenue),
+	}
+}
+
+func printJSON(w io.Writer, cfg Config, st Stats) error {
+	j := jsonSummary{
+		Seed:          cfg.seed,
+		BlockInterval: cfg.blockinterval,
+		StopHeight:    cfg.stopheight,
+		Duration:      cfg.duration,
+		Warmup:        cfg.warmup,
+		TotalHashrate: st.totalhash,
+		MinedBlocks:   st.mined,
+		TotalSimtime:  st.simtime,
+		AveBlockTime:  st.aveblock,
+		StaleBlocks:   st.stale,
+		StaleRate:     fraction(float64(st.stale), float64(st.mined)),
+		MaxReorgDepth: st.maxreorg,
+		Difficulty:    st.difficulty,
+		Retargets:     st.retargets,
+		DroppedRelays: st.dropped,
+		Uncles:        st.uncles,
+		Miners:        make([]jsonMiner, 0, len(st.minerstats)),
+		ReorgDepths:   make(map[int]int),
+	}
+	for depth, n := range st.reorgs {
+		if n > 0 {
+			j.ReorgDepths[depth] = n
+		}
+	}
+	if cfg.propagation {
+		p := st.proptimes
+		j.Propagation = &jsonPropagation{
+			Blocks: len(p),
+			Mean:   fraction(sum(p), float64(len(p))),
+		}
+		if len(p) > 0 {
+			j.Propagation.Pct90 = p[rank(len(p), 90)]
+			j.Propagation.Pct99 = p[rank(len(p), 99)]
+			j.Propagation.Max = p[len(p)-1]
+		}
+	}
+	for l, row := range st.displaced {
+		for w, n := range row {
+			if n > 0 {
+				j.Displaced = append(j.Displaced, jsonDisplaced{
+					st.minerstats[l].name, st.minerstats[w].name, n})
+			}
+		}
+	}
+	for d := 1; d < len(st.confirmed); d++ {
+		if j.Reversals == nil {
+			j.Reversals = make(map[int]float64)
+		}
+		j.Reversals[d] = fraction(float64(st.reversals[d]),
+			float64(st.confirmed[d]))
+	}
+	for d := 1; d < len(st.raceswon); d++ {
+		if j.DoubleSpends == nil {
+			j.Races = st.races
+			j.DoubleSpends = make(map[int]float64)
+		}
+		j.DoubleSpends[d] = fraction(float64(st.raceswon[d]),
+			float64(st.races))
+	}
+	for _, m := range st.minerstats {
+		j.Miners = append(j.Miners, st.jsonMiner(m))
+	}
+	for _, p := range st.poolstats {
+		j.Pools = append(j.Pools, st.jsonMiner(p))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(j)
+}
+
+func printSummary(cfg Config, st Stats) {
+	fmt.Printf("%-20s %14d\n", "seed-arg", cfg.seed)
+	fmt.Printf("%-20s %14d\n", "block-interval-arg", cfg.blockinterval)
+	if cfg.duration > 0 {
+		fmt.Printf("%-20s %14.3f\n", "duration-arg", cfg.duration)
+	} else {
+		fmt.Printf("%-20s %14d\n", "stopheight-arg", cfg.stopheight)
+	}
+	if cfg.warmup > 0 {
+		fmt.Printf("%-20s %14d\n", "warmup-arg", cfg.warmup)
+	}
+	fmt.Printf("%-20s %14s\n", "total-hashrate-arg",
+		formatHashrate(st.totalhash))
+	fmt.Printf("%-20s %14d\n", "mined-blocks", st.mined)
+	fmt.Printf("%-20s %14.3f\n", "total-simtime", st.simtime)
+	fmt.Printf("%-20s %14s\n", "ave-block-time",
+		ratio("%.3f", st.simtime-st.starttime, float64(st.bestchain)))
+	fmt.Printf("%-20s %14d\n", "stale-blocks", st.stale)
+	fmt.Printf("%-20s %15s\n", "stale-rate",
+		ratio("%.2f%%", float64(st.stale*100), float64(st.mined)))
+	fmt.Printf("%-20s %14d\n", "max-reorg-depth", st.maxreorg)
+	for depth, n := range st.reorgs {
+		if n > 0 {
+			fmt.Printf("%-20s %14d\n",
+				fmt.Sprintf("reorg-depth-%d", depth), n)
+		}
+	}
+	if cfg.retarget > 0 {
+		fmt.Printf("%-20s %14.3f\n", "final-difficulty", st.difficulty)
+		fmt.Printf("%-20s %14d\n", "retargets", st.retargets)
+	}
+	if cfg.loss > 0 {
+		fmt.Printf("%-20s %14d\n", "dropped-relays", st.dropped)
+	}
+	if cfg.queue {
+		fmt.Printf("%-20s %14d\n", "queued-relays", st.queued)
+		fmt.Printf("%-20s %14s\n", "ave-queue-wait",
+			ratio("%.3f", st.queuewait, float64(st.queued)))
+	}
+	if cfg.uncledepth > 0 {
+		fmt.Printf("%-20s %14d\n", "uncles", st.uncles)
+	}
+	if st.fees {
+		fmt.Printf("%-20s %14.3f\n", "total-revenue", st.revenue)
+	}
+	for i, n := range st.intervals {
+		fmt.Printf("%-20s %14d %7s\n",
+			fmt.Sprintf("interval-%g", float64(i)*cfg.buckets),
+			n, ratio("%.2f%%", float64(n*100), float64(st.bestchain)))
+	}
+	for d := 1; d < len(st.confirmed); d++ {
+		fmt.Printf("%-20s %14s %d/%d\n",
+			fmt.Sprintf("reversal-conf-%d", d),
+			ratio("%.6f", float64(st.reversals[d]),
+				float64(st.confirmed[d])),
+			st.reversals[d], st.confirmed[d])
+	}
+	if cfg.doublespend > 0 {
+		printRaces(st.races, st.raceswon)
+	}
+	if cfg.propagation {
+		p := st.proptimes
+		fmt.Printf("%-20s %14d\n", "propagated-blocks", len(p))
+		fmt.Printf("%-20s %14s\n", "propagation-mean",
+			ratio("%.3f", sum(p), float64(len(p))))
+		fmt.Printf("%-20s %14s\n", "propagation-90pct", percentile(p, 90))
+		fmt.Printf("%-20s %14s\n", "propagation-99pct", percentile(p, 99))
+		fmt.Printf("%-20s %14s\n", "propagation-max", percentile(p, 100))
+	}
+	for _, m := range st.minerstats {
+		st.printMiner("miner", m)
+	}
+	for _, p := range st.poolstats {
+		st.printMiner("pool ", p)
+	}
+	if cfg.isolation > 0 {
+		st.printIsolated(cfg.isolation)
+	}
+	for l, row := range st.displaced {
+		for w, n := range row {
+			if n > 0 {
+				fmt.Printf("displaced %-13s  by %-13s %10d\n",
+					st.minerstats[l].name, st.minerstats[w].name, n)
+			}
+		}
+	}
+}
+
+// Print the double-spend success probability for each number of
+// confirmations, followed by the counts.
+func printRaces(races int, won []int) {
+	fmt.Printf("%-20s %14d\n", "races", races)
+	for d := 1; d < len(won); d++ {
+		fmt.Printf("%-20s %14s %d/%d\n",
+			fmt.Sprintf("doublespend-conf-%d", d),
+			ratio("%.6f", float64(won[d]), float64(races)),
+			won[d], races)
+	}
+}
+
+// List the miners whose share of the best chain is less than their share
+// of the hashrate divided by factor; these are usually poorly connected
+// (their blocks don't reach the rest of the network quickly). The hashrate
+// shares are averaged over time, since miners may join, leave, or change
+// their hashrate (see minerStats.avehash).
+func (st *Stats) printIsolated(factor float64) {
+	var avehash float64
+	for _, m := range st.minerstats {
+		avehash += m.avehash
+	}
+	if st.bestchain == 0 || avehash == 0 {
+		return
+	}
+	for _, m := range st.minerstats {
+		hashfrac := m.avehash / avehash
+		blockfrac := float64(m.credit) / float64(st.bestchain)
+		if blockfrac*factor >= hashfrac {
+			continue
+		}
+		fmt.Printf("isolated %-13s  hashrate %6.2f%% blocks %6.2f%% "+
+			"ave-peer-delay %.3f\n", m.name,
+			hashfrac*100, blockfrac*100, m.delay)
+	}
+}
+
+func (st *Stats) printMiner(kind string, m minerStats) {
+	fmt.Printf("%s %-13s  hashrate-arg %6s %7s ", kind, m.name,
+		formatHashrate(m.hashrate), ratio("%.2f%%", m.hashrate*100,
+			st.totalhash))
+	fmt.Printf("blocks %7s ",
+		ratio("%.2f%%", float64(m.credit*100), float64(st.bestchain)))
+	fmt.Printf("stale-rate %7s",
+		ratio("%.2f%%", float64((m.mined-m.credit)*100), float64(m.mined)))
+	if st.scheduled {
+		fmt.Printf(" ave-hashrate %9.2f", m.avehash)
+	}
+	if st.uncled {
+		fmt.Printf(" uncles %6d", m.uncles)
+	}
+	if st.fees {
+		fmt.Printf(" revenue %7s", ratio("%.2f%%", m.revenue*100, st.revenue))
 	}
+	fmt.Println("")
 }
@@ -0,0 +1,655 @@
+package main
+
+// To run: go test minesim.go minesim_test.go
+// To benchmark: go test -bench . -run '^$' minesim.go minesim_test.go
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Return a configuration (with the main() defaults that matter) for the
+// given network file contents.
+func testConfig(t testing.TB, topology string) Config {
+	t.Helper()
+	net, err := parseNetwork(strings.NewReader(topology), "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		miners:        net.miners,
+		partitions:    net.partitions,
+		blockinterval: 600,
+		stopheight:    1000,
+		cleanup:       10000,
+		subsidy:       1,
+		sigma:         1,
+		headerdelay:   0.25,
+		attempts:      100,
+	}
+}
+
+// Run the simulation, failing the test on error.
+func testRun(t testing.TB, cfg Config) Stats {
+	t.Helper()
+	st, err := simulate(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// Simulator throughput on a moderate-size network (24 miners, see
+// testdata/bench-network); reports events per second of wall-clock time.
+func BenchmarkSimulate(b *testing.B) {
+	topology, err := os.ReadFile("testdata/bench-network")
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg := testConfig(b, string(topology))
+	cfg.stopheight = 20000
+	var events int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The same seed each time, so every iteration does the same work.
+		events += testRun(b, cfg).events
+	}
+	b.ReportMetric(float64(events)/b.Elapsed().Seconds(), "events/s")
+}
+
+// A run that stops before any block is on every miner's chain has no
+// best-chain blocks; nothing is counted, and the ratios are n/a (not NaN).
+func TestZeroConfirmed(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 10\nb 1 a 10\n")
+	cfg.stopheight = 1
+	st := testRun(t, cfg)
+	if st.mined != 0 || st.bestchain != 0 || st.stale != 0 {
+		t.Fatalf("mined %d bestchain %d stale %d, want all zero",
+			st.mined, st.bestchain, st.stale)
+	}
+	if st.stalerate != 0 || st.aveblock != 0 {
+		t.Fatalf("stale rate %v ave block %v, want zero",
+			st.stalerate, st.aveblock)
+	}
+	for _, m := range st.minerstats {
+		if m.mined != 0 || m.credit != 0 {
+			t.Fatalf("miner %s mined %d credit %d, want zero",
+				m.name, m.mined, m.credit)
+		}
+	}
+	if r := ratio("%.3f", st.simtime, float64(st.bestchain)); r != "n/a" {
+		t.Fatalf("ave-block-time %s, want n/a", r)
+	}
+	if err := printJSON(io.Discard, cfg, st); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// With a single miner, every block it mines is on the best chain.
+func TestSingleBlock(t *testing.T) {
+	cfg := testConfig(t, "solo 1\n")
+	cfg.stopheight = 1
+	st := testRun(t, cfg)
+	if st.mined != 1 || st.bestchain != 1 || st.stale != 0 {
+		t.Fatalf("mined %d bestchain %d stale %d, want 1 1 0",
+			st.mined, st.bestchain, st.stale)
+	}
+	if m := st.minerstats[0]; m.mined != 1 || m.credit != 1 {
+		t.Fatalf("mined %d credit %d, want 1 1", m.mined, m.credit)
+	}
+	if st.aveblock != st.simtime {
+		t.Fatalf("ave block %v, want %v", st.aveblock, st.simtime)
+	}
+}
+
+// The mined and best-chain counts cover the same blocks, so even very
+// short runs can't have a negative number of stale blocks.
+func TestShortRuns(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 50\nb 1 a 50\n")
+	for seed := int64(0); seed < 20; seed++ {
+		for h := int64(1); h <= 5; h++ {
+			cfg.seed, cfg.stopheight = seed, h
+			st := testRun(t, cfg)
+			if st.stale < 0 || st.stale != st.mined-st.bestchain {
+				t.Fatalf("seed %d height %d: mined %d bestchain %d stale %d",
+					seed, h, st.mined, st.bestchain, st.stale)
+			}
+			for _, m := range st.minerstats {
+				if m.credit > m.mined {
+					t.Fatalf("seed %d height %d: miner %s mined %d credit %d",
+						seed, h, m.name, m.mined, m.credit)
+				}
+			}
+		}
+	}
+}
+
+// A network is connected if every miner can receive every other miner's
+// blocks, directly or not; the members of a pool share their blocks.
+func TestConnectivity(t *testing.T) {
+	for topology, connected := range map[string]bool{
+		"a 1 b 1\nb 1 a 1\n":                         true,
+		"a 1 c 1\nb 1 a 1\nc 1 a 1\n":                false,
+		"a 1 c 1 pool p\nb 1 pool p\nc 1 a 1\n":      true,
+		"a 1 c 1 pool p\nb 1 pool q\nc 1 a 1\n":      false,
+		"a 1 b 1 pool p\nb 1 c 1\nc 1 pool p\nd 1\n": false,
+	} {
+		err := checkConnectivity(testConfig(t, topology).miners)
+		if (err == nil) != connected {
+			t.Errorf("topology %q: connected %v, error %v", topology,
+				connected, err)
+		}
+	}
+}
+
+// Negative counts that size the statistics are rejected rather than
+// panicking, both by a single run and by the Monte Carlo driver.
+func TestNegativeCounts(t *testing.T) {
+	for name, set := range map[string]func(*Config){
+		"doublespend": func(cfg *Config) { cfg.doublespend = -3 },
+		"k":           func(cfg *Config) { cfg.k = -2 },
+		"k=-1":        func(cfg *Config) { cfg.k = -1 },
+	} {
+		cfg := testConfig(t, "a 1 b 50\nb 1 a 50\n")
+		set(&cfg)
+		if _, err := simulate(cfg); err == nil {
+			t.Errorf("%s: simulate accepted a negative count", name)
+		}
+		if err := monteCarlo(cfg, 2, false); err == nil {
+			t.Errorf("%s: monteCarlo accepted a negative count", name)
+		}
+	}
+}
+
+// When the chains of two genesis blocks are connected, the losing chain's
+// blocks are stale but not uncles, whichever genesis block lost. With no
+// relay delay, no other stale blocks are possible.
+func TestGenesisNoUncles(t *testing.T) {
+	cfg := testConfig(t, "a 50 b 0 genesis X\nb 50 a 0\npartition 0 60000 a b\n")
+	cfg.stopheight = 500
+	cfg.uncledepth = 2
+	losers := make(map[string]bool)
+	for seed := int64(0); seed < 10; seed++ {
+		cfg.seed = seed
+		st := testRun(t, cfg)
+		if st.stale == 0 {
+			t.Fatalf("seed %d: no stale blocks", seed)
+		}
+		if st.uncles != 0 {
+			t.Fatalf("seed %d: %d uncles, want none", seed, st.uncles)
+		}
+		for _, m := range st.minerstats {
+			if m.credit < m.mined {
+				losers[m.name] = true
+			}
+		}
+	}
+	if !losers["a"] || !losers["b"] {
+		t.Fatalf("losing chains %v, want both", losers)
+	}
+}
+
+// The CSV log has one row per mined block, including those not yet
+// settled at the end of the run, and agrees with the summary.
+func TestCSVEveryBlock(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 20\nb 1 a 20 c 5\nc 2 b 5\n")
+	cfg.stopheight = 2000
+	for seed := int64(0); seed < 5; seed++ {
+		var log strings.Builder
+		cfg.seed, cfg.csvlog = seed, &log
+		st := testRun(t, cfg)
+		rows, err := csv.NewReader(strings.NewReader(log.String())).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := make(map[string]height)
+		for i, row := range rows[1:] {
+			// Block ids are consecutive from just after the genesis block.
+			if want := strconv.Itoa(1001 + i); row[0] != want {
+				t.Fatalf("seed %d: row %d blockid %s, want %s",
+					seed, i, row[0], want)
+			}
+			count[row[6]]++
+		}
+		if count["true"] != st.bestchain || count["false"] != st.stale ||
+			count["true"]+count["false"] != st.mined {
+			t.Fatalf("seed %d: rows %v, summary mined %d bestchain %d stale %d",
+				seed, count, st.mined, st.bestchain, st.stale)
+		}
+		if count["unknown"] == 0 {
+			t.Fatalf("seed %d: no unsettled blocks", seed)
+		}
+	}
+}
+
+// Each trace line is attributed to the miner acting, not found by its
+// text, so a miner named like a network-wide event ("retarget") is traced
+// correctly, and a dropped relay is shown to the miner it was dropped to.
+func TestTraceMiner(t *testing.T) {
+	cfg := testConfig(t, "retarget 1 b 20\nb 1 retarget 20\n")
+	cfg.stopheight = 500
+	cfg.retarget = 100
+	cfg.loss = 0.2
+	var traced, drops int
+	cfg.trace = func(mi, peer int, format string, a ...interface{}) {
+		line := fmt.Sprintf(format, a...)
+		fields := strings.Fields(line)
+		if mi >= 0 && fields[1] != cfg.miners[mi].name {
+			t.Fatalf("line %q attributed to miner %s", line, cfg.miners[mi].name)
+		}
+		if mi < 0 && fields[1] == "retarget" && fields[2] != "height" {
+			t.Fatalf("line %q not attributed to a miner", line)
+		}
+		if mi == 0 || peer == 0 {
+			traced++
+		}
+		if fields[2] == "drop" && peer == 0 {
+			drops++
+		}
+	}
+	testRun(t, cfg)
+	if traced == 0 || drops == 0 {
+		t.Fatalf("traced %d lines, %d drops to miner 0", traced, drops)
+	}
+}
+
+// The finalized block (the newest one on every active miner's chain) is
+// maintained as tips move; with check set, checkState() compares it with
+// the result of moving back from every tip (as cleanBlocks() used to)
+// after each event. The results don't depend on how often blocks are
+// pruned.
+func TestFinalized(t *testing.T) {
+	topologies := []string{
+		"a 1 b 100 c 300\nb 1 a 100 c 200\nc 1 a 300 b 200\n",
+		// Miners joining and leaving.
+		"a 3 b 5 c 5 d 5\nb 3 a 5 d 5 joinat 20000 leaveat 200000\n" +
+			"c 2 a 5 d 5 leaveat 100000\nd 2 a 5 b 5 c 5 joinat 50000\n",
+		// Two genesis blocks whose chains are connected later.
+		"a 50 b 1 genesis X\nb 50 a 1\npartition 0 60000 a b\n",
+		"a 4 selfish b 1\nb 6 a 1\n",
+		"a 1 b 1 c 30 pool p\nb 1 a 1 pool p\nc 2 a 30\n",
+	}
+	// Whether the results should be the same for each cleanup interval:
+	// with last-seen, a block whose branch was pruned while it was being
+	// relayed could have won a tie (see -cleanup in the README).
+	options := []struct {
+		set     func(*Config)
+		cadence bool
+	}{
+		{func(cfg *Config) {}, true},
+		// Miners can switch to a branch that forks below the
+		// finalized block.
+		{func(cfg *Config) { cfg.tiebreak = "last-seen" }, false},
+		{func(cfg *Config) { cfg.ghost, cfg.blockinterval = true, 20 }, true},
+	}
+	network, err := os.ReadFile("network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topologies = append(topologies, string(network))
+	for ti, topology := range topologies {
+		for oi, option := range options {
+			cfg := testConfig(t, topology)
+			cfg.stopheight = 300
+			cfg.check = true
+			cfg.uncledepth = 2
+			cfg.k = 3
+			option.set(&cfg)
+			for seed := int64(0); seed < 5; seed++ {
+				cfg.seed = seed
+				var want Stats
+				for _, cleanup := range []int64{10000, 7, 1} {
+					cfg.cleanup = cleanup
+					st := testRun(t, cfg)
+					st.elapsed = 0
+					if cleanup == 10000 {
+						want = st
+					} else if option.cadence && !reflect.DeepEqual(st, want) {
+						t.Fatalf("topology %d option %d seed %d cleanup %d: stats\n%+v\nwant\n%+v",
+							ti, oi, seed, cleanup, st, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Best-chain blocks' confirmations are counted at the end of the run (each
+// has as many as the highest tip gives it), so the reversal table doesn't
+// depend on how often blocks are pruned.
+func TestConfirmations(t *testing.T) {
+	cfg := testConfig(t, "solo 1\n")
+	cfg.stopheight = 100
+	cfg.k = 3
+	cfg.warmup = 20
+	st := testRun(t, cfg)
+	for d := 1; d <= cfg.k; d++ {
+		// The highest block has one confirmation, and so on down.
+		if want := int(st.bestchain) - d + 1; st.confirmed[d] != want ||
+			st.reversals[d] != 0 {
+			t.Fatalf("%d confirmations: confirmed %d reversals %d, want %d 0",
+				d, st.confirmed[d], st.reversals[d], want)
+		}
+	}
+
+	cfg = testConfig(t, "a 1 b 200\nb 1 a 200\n")
+	cfg.stopheight = 500
+	cfg.k = 3
+	for seed := int64(0); seed < 5; seed++ {
+		cfg.seed = seed
+		var want Stats
+		for _, cleanup := range []int64{10000, 1} {
+			cfg.cleanup = cleanup
+			st := testRun(t, cfg)
+			if cleanup == 10000 {
+				want = st
+			} else if !reflect.DeepEqual(st.confirmed, want.confirmed) ||
+				!reflect.DeepEqual(st.reversals, want.reversals) {
+				t.Fatalf("seed %d cleanup %d: confirmed %v reversals %v, want %v %v",
+					seed, cleanup, st.confirmed, st.reversals,
+					want.confirmed, want.reversals)
+			}
+		}
+		// Every block was at the tip of its miner's chain.
+		if want.confirmed[1] != int(want.mined) {
+			t.Fatalf("seed %d: confirmed %v, mined %d", seed,
+				want.confirmed, want.mined)
+		}
+		for d := 1; d <= cfg.k; d++ {
+			if want.reversals[d] > want.confirmed[d] ||
+				d > 1 && want.confirmed[d] > want.confirmed[d-1] {
+				t.Fatalf("seed %d: confirmed %v reversals %v", seed,
+					want.confirmed, want.reversals)
+			}
+		}
+		if want.reversals[1] == 0 {
+			t.Fatalf("seed %d: no reversals", seed)
+		}
+	}
+}
+
+// A stale block is an uncle if it's at most uncledepth blocks above the
+// best chain; this is worked out here from the CSV log (which has every
+// block's parent), and must not depend on how often blocks are pruned
+// (a stale block's parent may be pruned before it is).
+func TestUncles(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 300\nb 1 a 300 c 100\nc 1 b 100\n")
+	cfg.stopheight = 500
+	for seed := int64(0); seed < 5; seed++ {
+		for _, depth := range []int{1, 2, 1000} {
+			for _, cleanup := range []int64{10000, 1} {
+				var log strings.Builder
+				cfg.seed, cfg.uncledepth, cfg.cleanup = seed, depth, cleanup
+				cfg.csvlog = &log
+				st := testRun(t, cfg)
+				rows, err := csv.NewReader(strings.NewReader(log.String())).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Distance above the best chain, by block id (the
+				// genesis block, 1000, is on the best chain).
+				above := map[string]int{"1000": 0}
+				var uncles height
+				for _, row := range rows[1:] {
+					switch row[6] {
+					case "true":
+						above[row[0]] = 0
+					case "false":
+						above[row[0]] = above[row[4]] + 1
+						if above[row[0]] <= depth {
+							uncles++
+						}
+					}
+				}
+				if st.uncles != uncles {
+					t.Fatalf("seed %d depth %d cleanup %d: %d uncles, want %d",
+						seed, depth, cleanup, st.uncles, uncles)
+				}
+				if depth == 1000 && uncles != st.stale {
+					t.Fatalf("seed %d: %d uncles, want all %d stale blocks",
+						seed, uncles, st.stale)
+				}
+			}
+		}
+	}
+}
+
+// With GHOST, each miner weighs subtrees by the blocks it has seen, not
+// all the blocks mined so far.
+func TestGhostObserved(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 10\nb 1 a 10\n")
+	cfg.ghost = true
+	s := newState(cfg, exponential, firstSeen)
+	// Genesis (1000) has children 1001 (a's) and 1002 (b's), and 1002
+	// has a child 1003 (b's).
+	for _, b := range []block{
+		{parent: 1000, height: 1, miner: 0},
+		{parent: 1000, height: 1, miner: 1},
+		{parent: 1002, height: 2, miner: 1},
+	} {
+		b.weights = make([]int, len(s.miners))
+		s.blocks = append(s.blocks, b)
+	}
+	s.miners[0].tip = 1001
+	s.see(0, 1001)
+	s.see(1, 1003)
+	// Miner a receives 1002 before 1003: with only what it has seen,
+	// each side has one block (a tie, and a keeps its tip).
+	s.see(0, 1002)
+	if s.ghostBetter(0, 1002) {
+		t.Fatal("switched to 1002, which has only one seen block")
+	}
+	if w := s.getblock(1000).weights; w[0] != 3 || w[1] != 3 {
+		t.Fatalf("genesis weights %v, want [3 3]", w)
+	}
+	s.see(0, 1003)
+	if !s.ghostBetter(0, 1003) {
+		t.Fatal("didn't switch to 1003, whose side has two seen blocks")
+	}
+}
+
+// With -compact, a miner relays a block once, when the first full copy
+// arrives. Relaying every copy sent the block back and forth forever
+// whenever peers didn't skip equal-height blocks (with -ghost, or a
+// tiebreak other than first-seen).
+func TestCompactRelayOnce(t *testing.T) {
+	// (With more peers, the copies would multiply.)
+	cfg := testConfig(t, "a 1 b 1\nb 1 a 1\n")
+	cfg.compact = true
+	cfg.stopheight = 0
+	cfg.duration = 6000
+	for _, option := range []func(*Config){
+		func(cfg *Config) { cfg.tiebreak = "first-seen" },
+		func(cfg *Config) { cfg.tiebreak = "last-seen" },
+		func(cfg *Config) { cfg.ghost = true },
+	} {
+		option(&cfg)
+		st := testRun(t, cfg)
+		// Each block is relayed once over each link, as a header
+		// and as a full block.
+		links := 0
+		for _, m := range cfg.miners {
+			links += len(m.peers)
+		}
+		if limit := int64(st.mined+1) * int64(2*links+10); st.events > limit {
+			t.Fatalf("tiebreak %q ghost %v: %d events for %d blocks",
+				cfg.tiebreak, cfg.ghost, st.events, st.mined)
+		}
+	}
+}
+
+// Under a tiebreak that can switch, a miner breaks a tie with each block
+// at most once, so copies of equal-height blocks arriving over different
+// links don't flip miners between tips indefinitely.
+func TestTiebreakOnce(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 40 c 60 d 20\nb 1 a 40 c 30 d 50\n"+
+		"c 1 a 60 b 30 d 40\nd 1 a 20 b 50 c 40\n")
+	cfg.stopheight = 0
+	cfg.duration = 600000
+	links := 0
+	for _, m := range cfg.miners {
+		links += len(m.peers)
+	}
+	for _, tiebreak := range []string{"last-seen", "random"} {
+		for _, dist := range []string{"exponential", "lognormal"} {
+			cfg.tiebreak, cfg.dist = tiebreak, dist
+			st := testRun(t, cfg)
+			if limit := int64(st.mined+1) * int64(links+10); st.events > limit {
+				t.Fatalf("%s %s: %d events for %d blocks",
+					tiebreak, dist, st.events, st.mined)
+			}
+			// Each reorg switches a miner to a block it hadn't mined on.
+			reorgs := 0
+			for _, n := range st.reorgs {
+				reorgs += n
+			}
+			if reorgs == 0 || reorgs > int(st.mined)*len(cfg.miners) {
+				t.Fatalf("%s %s: %d reorgs for %d blocks",
+					tiebreak, dist, reorgs, st.mined)
+			}
+		}
+	}
+}
+
+// A run saved to a checkpoint and resumed has the same results as one that
+// wasn't interrupted, and a checkpoint can't be resumed with options that
+// shape the saved state, or with a different network.
+func TestResume(t *testing.T) {
+	topology := "a 1 b 1 c 30 pool p\nb 1 a 1 pool p\nc 2 a 30 b 40\n"
+	pathname := t.TempDir() + "/checkpoint"
+	for oi, option := range []func(*Config){
+		func(cfg *Config) {},
+		func(cfg *Config) { cfg.tiebreak = "last-seen" },
+		func(cfg *Config) { cfg.ghost = true },
+		func(cfg *Config) { cfg.propagation, cfg.k = true, 3 },
+		func(cfg *Config) { cfg.bandwidth, cfg.queue = 1e5, true },
+	} {
+		cfg := testConfig(t, topology)
+		cfg.stopheight = 600
+		cfg.blockinterval = 60
+		option(&cfg)
+		want := testRun(t, cfg)
+		want.elapsed = 0
+
+		saving := cfg
+		saving.stopheight = 300
+		saving.checkpoint, saving.checkevery = pathname, 100
+		testRun(t, saving)
+		ck, err := readCheckpoint(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resuming := cfg
+		resuming.resume = ck
+		st := testRun(t, resuming)
+		st.elapsed = 0
+		if !reflect.DeepEqual(st, want) {
+			t.Fatalf("option %d: resumed stats\n%+v\nwant\n%+v", oi, st, want)
+		}
+
+		for name, change := range map[string]func(*Config){
+			"seed":        func(cfg *Config) { cfg.seed++ },
+			"tiebreak":    func(cfg *Config) { cfg.tiebreak = "random" },
+			"ghost":       func(cfg *Config) { cfg.ghost = !cfg.ghost },
+			"propagation": func(cfg *Config) { cfg.propagation = !cfg.propagation },
+			"queue":       func(cfg *Config) { cfg.queue = !cfg.queue },
+			"k":           func(cfg *Config) { cfg.k++ },
+			"network": func(cfg *Config) {
+				cfg.miners = testConfig(t, strings.Replace(topology,
+					"c 2", "c 3", 1)).miners
+			},
+		} {
+			mismatched := resuming
+			change(&mismatched)
+			if _, err := simulate(mismatched); err == nil {
+				t.Fatalf("option %d: resumed with a different %s", oi, name)
+			}
+		}
+	}
+}
+
+// Replaying a recorded run reproduces it exactly, even if the choices would
+// be made differently now (here, with a different solve time distribution).
+func TestReplay(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 30 c 50\nb 2 a 30 c 20\nc 1 a 50 b 20\n")
+	cfg.stopheight = 500
+	cfg.loss, cfg.jitter, cfg.fanout = 0.1, 0.5, 1
+	var tape bytes.Buffer
+	cfg.record = &tape
+	want := testRun(t, cfg)
+	want.elapsed = 0
+	cfg.record, cfg.replay = nil, &tape
+	cfg.dist = "lognormal"
+	st := testRun(t, cfg)
+	st.elapsed = 0
+	if !reflect.DeepEqual(st, want) {
+		t.Fatalf("replayed stats\n%+v\nwant\n%+v", st, want)
+	}
+}
+
+// With zero jitter, relay delays make no random choices, so the run is the
+// same as one without -jitter.
+func TestZeroJitter(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 30 c 50\nb 2 a 30 c 20\nc 1 a 50 b 20\n")
+	cfg.loss = 0.1
+	var want, tape bytes.Buffer
+	cfg.record = &want
+	wantst := testRun(t, cfg)
+	cfg.jitter, cfg.record = 0, &tape
+	st := testRun(t, cfg)
+	st.elapsed, wantst.elapsed = 0, 0
+	if !reflect.DeepEqual(st, wantst) {
+		t.Fatalf("stats\n%+v\nwant\n%+v", st, wantst)
+	}
+	if strings.Contains(tape.String(), " jitter ") ||
+		!bytes.Equal(tape.Bytes(), want.Bytes()) {
+		t.Fatal("zero jitter made different random choices")
+	}
+}
+
+// A fanout at least as large as a miner's number of peers relays to all of
+// them without a random choice, so the run is the same as one without it.
+func TestFanoutAllPeers(t *testing.T) {
+	cfg := testConfig(t, "a 1 b 30 c 50 d 10\nb 2 a 30 c 20\n"+
+		"c 1 a 50 b 20 d 40\nd 1 c 40 a 10\n")
+	cfg.jitter = 0.5
+	var want bytes.Buffer
+	cfg.record = &want
+	wantst := testRun(t, cfg)
+	wantst.elapsed = 0
+	for _, fanout := range []int{3, 4, 100} {
+		var tape bytes.Buffer
+		cfg.fanout, cfg.record = fanout, &tape
+		st := testRun(t, cfg)
+		st.elapsed = 0
+		if !reflect.DeepEqual(st, wantst) {
+			t.Fatalf("fanout %d: stats\n%+v\nwant\n%+v", fanout, st, wantst)
+		}
+		if !bytes.Equal(tape.Bytes(), want.Bytes()) {
+			t.Fatalf("fanout %d made different random choices", fanout)
+		}
+	}
+}
+
+// A selfish miner's share of the best chain matches Eyal and Sirer's
+// revenue formula (with gamma zero: the honest miner, having mined the
+// competing block, always mines on it).
+func TestSelfishRevenue(t *testing.T) {
+	cfg := testConfig(t, "a 4 selfish b 0\nb 6 a 0\n")
+	cfg.stopheight = 100000
+	st := testRun(t, cfg)
+	const alpha = 0.4
+	want := (alpha*(1-alpha)*(1-alpha)*4*alpha - alpha*alpha*alpha) /
+		(1 - alpha*(1+(2-alpha)*alpha))
+	got := float64(st.minerstats[0].credit) / float64(st.bestchain)
+	if got < want-0.01 || got > want+0.01 {
+		t.Fatalf("selfish revenue %.4f, want %.4f", got, want)
+	}
+}